@@ -12,7 +12,9 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/ipfs/go-cid"
 	"openmesh.network/aggregationpoc/internal/ipfs"
+	"openmesh.network/aggregationpoc/internal/model"
 )
 
 // HTTPInstance is a Gin HTTP server
@@ -27,8 +29,9 @@ func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, Range")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, ETag")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -52,6 +55,120 @@ func NewHTTPInstance(httpPort int, ipfsInstance *ipfs.Instance) *HTTPInstance {
 		// This returns ipfs instance's libp2p address
 		c.Data(http.StatusOK, "text/plain", []byte(ipfs.HostToString(ipfsInstance.Host)))
 	})
+	s.GET("/cluster", func(c *gin.Context) {
+		// Who holds which block, as far as gossip knows
+		if ipfsInstance.Cluster == nil {
+			c.JSON(http.StatusOK, []model.NodeState{})
+			return
+		}
+		c.JSON(http.StatusOK, ipfsInstance.Cluster.ClusterState())
+	})
+	s.GET("/storage", func(c *gin.Context) {
+		// Bytes in the blockstore split by leaves, metadata and cache, against the quota
+		c.JSON(http.StatusOK, ipfsInstance.StorageReport())
+	})
+	s.GET("/sync", func(c *gin.Context) {
+		// Blocks waiting to be fetched and how fast they're coming in
+		c.JSON(http.StatusOK, ipfsInstance.SyncStats())
+	})
+	s.GET("/metadata", func(c *gin.Context) {
+		// How far along resolving the leaves of every source is
+		c.JSON(http.StatusOK, ipfsInstance.MetadataProgress())
+	})
+	s.GET("/hot", func(c *gin.Context) {
+		// The most requested leaves lately, how often and how many copies there are
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		c.JSON(http.StatusOK, ipfsInstance.HotBlocks(limit))
+	})
+	s.GET("/pins", func(c *gin.Context) {
+		// What keeps the blocks of every source from being collected
+		c.JSON(http.StatusOK, ipfsInstance.Pins())
+	})
+	s.GET("/scrub", func(c *gin.Context) {
+		// Blocks checked for corruption, and how many were found and repaired
+		c.JSON(http.StatusOK, ipfsInstance.ScrubStats())
+	})
+	s.GET("/bandwidth", func(c *gin.Context) {
+		// Limits and throughput of bitswap, overall and by peer
+		c.JSON(http.StatusOK, ipfsInstance.BandwidthStats())
+	})
+	s.PUT("/bandwidth", func(c *gin.Context) {
+		// Fields left out keep their current limit
+		limits := ipfsInstance.BandwidthStats().Limits
+		if err := c.ShouldBindJSON(&limits); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := ipfsInstance.SetBandwidthLimits(limits); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, limits)
+	})
+	s.GET("/drain", func(c *gin.Context) {
+		c.JSON(http.StatusOK, ipfsInstance.DrainStatus())
+	})
+	s.POST("/drain", func(c *gin.Context) {
+		// The node shuts down once it's drained, progress is on GET /drain
+		ipfsInstance.RequestDrain()
+		c.JSON(http.StatusAccepted, ipfsInstance.DrainStatus())
+	})
+	s.GET("/reputation", func(c *gin.Context) {
+		// Every peer's score, the best first
+		c.JSON(http.StatusOK, ipfsInstance.Reputation())
+	})
+	s.GET("/challenges", func(c *gin.Context) {
+		// How every peer did proving it stores the leaves it claims
+		c.JSON(http.StatusOK, ipfsInstance.ChallengeResults())
+	})
+	s.GET("/gc", func(c *gin.Context) {
+		c.JSON(http.StatusOK, ipfsInstance.LastGC())
+	})
+	s.POST("/gc", func(c *gin.Context) {
+		// Collects right away and reports what was freed
+		report, err := ipfsInstance.CollectGarbage(c.Request.Context(), ipfs.GC_MANUAL)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	})
+	s.POST("/sources", func(c *gin.Context) {
+		ingestSource(c, ipfsInstance)
+	})
+	s.DELETE("/sources/:name", func(c *gin.Context) {
+		err := ipfsInstance.RemoveSource(c.Request.Context(), c.Param("name"))
+		if errors.Is(err, ipfs.ErrSourceNotFound) {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+	s.GET("/sources/:name", func(c *gin.Context) {
+		serveSource(c, ipfsInstance)
+	})
+	s.GET("/sources/:name/*path", func(c *gin.Context) {
+		serveSource(c, ipfsInstance)
+	})
+	s.GET("/cid/:cid", func(c *gin.Context) {
+		root, err := cid.Parse(c.Param("cid"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid cid: "+err.Error())
+			return
+		}
+
+		serveCid(c, ipfsInstance, root, root.String())
+	})
+	s.GET("/car/:ref", func(c *gin.Context) {
+		exportCar(c, ipfsInstance)
+	})
+	s.POST("/car", func(c *gin.Context) {
+		importCar(c, ipfsInstance)
+	})
 	s.GET("/dashboard", func(c *gin.Context) {
 		bytes, _ := os.ReadFile("index.html")
 		c.Data(http.StatusOK, "text/html", []byte(bytes))
@@ -59,6 +176,11 @@ func NewHTTPInstance(httpPort int, ipfsInstance *ipfs.Instance) *HTTPInstance {
 	s.GET("/htmx/status", func(c *gin.Context) {
 		s := ""
 
+		if ipfsInstance.Draining() {
+			c.Data(http.StatusOK, "text/html", []byte("draining..."))
+			return
+		}
+
 		switch ipfsInstance.Status {
 		case ipfs.DOWN:
 			s = "down"
@@ -78,6 +200,12 @@ func NewHTTPInstance(httpPort int, ipfsInstance *ipfs.Instance) *HTTPInstance {
 		case ipfs.SEEDING_BLOCKS:
 			s = "seeding blocks..."
 			break
+		case ipfs.SERVING_GATEWAY:
+			s = "serving as a gateway..."
+			break
+		case ipfs.OBSERVING:
+			s = "observing..."
+			break
 		default:
 			s = "unknown..."
 			break
@@ -93,7 +221,7 @@ func NewHTTPInstance(httpPort int, ipfsInstance *ipfs.Instance) *HTTPInstance {
 				size, err := strconv.Atoi(value[0])
 
 				if err == nil && size > 1 {
-					ipfsInstance.StorageSize = size * 1024 * 1024
+					ipfsInstance.SetStorageSize(size * 1024 * 1024)
 				}
 
 				break
@@ -103,7 +231,7 @@ func NewHTTPInstance(httpPort int, ipfsInstance *ipfs.Instance) *HTTPInstance {
 		s := ""
 		// TODO(Tom): This is really gross, clean this up
 		s += "<form hx-get=\"http://" + os.Getenv("XNODE_IP") + ":9080/htmx/resize\">\n"
-		s += "<input class=\"sizeinput\" type=number name=\"size\" placeholder=\"Storage size in megabytes\" value=\"" + strconv.Itoa(ipfsInstance.StorageSize/(1024*1024)) + "\"/>"
+		s += "<input class=\"sizeinput\" type=number name=\"size\" placeholder=\"Storage size in megabytes\" value=\"" + strconv.Itoa(ipfsInstance.StorageSize()/(1024*1024)) + "\"/>"
 		s += "</form>\n"
 
 		c.Data(286, "text/html", []byte(s))
@@ -128,10 +256,16 @@ func NewHTTPInstance(httpPort int, ipfsInstance *ipfs.Instance) *HTTPInstance {
 		sourcesTotal := 0
 		blocksTotal := 0
 		ipfsInstance.BlockMapsMutex.Lock()
-		for _, s := range ipfsInstance.Sources {
+		blocksSeeding := make(map[string][]int, len(ipfsInstance.BlocksSeeding))
+		for k, v := range ipfsInstance.BlocksSeeding {
+			blocksSeeding[k] = v
+		}
+		ipfsInstance.BlockMapsMutex.Unlock()
+
+		for _, s := range ipfsInstance.SourceList() {
 			hasABlockInSource := false
-			for _, i := range ipfsInstance.BlocksSeeding[s.Name] {
-				newBytes, _ := s.BlockSize(i)
+			for _, i := range blocksSeeding[s.Name] {
+				newBytes, _ := ipfsInstance.LeafSize(s, i)
 				bytesTotal += int(newBytes)
 				hasABlockInSource = true
 				blocksTotal += 1
@@ -141,10 +275,12 @@ func NewHTTPInstance(httpPort int, ipfsInstance *ipfs.Instance) *HTTPInstance {
 				sourcesTotal += 1
 			}
 		}
-		ipfsInstance.BlockMapsMutex.Unlock()
 
 		s += "<p>Seeding " + strconv.Itoa(bytesTotal/1024) + "KB in " + strconv.Itoa(blocksTotal) + " blocks. "
 		s += "For " + strconv.Itoa(sourcesTotal) + " sources.</p>\n"
+		report := ipfsInstance.StorageReport()
+		s += "<p>Using " + strconv.FormatInt(report.Used/1024, 10) + "KB of " + strconv.FormatInt(report.Quota/1024, 10) + "KB, "
+		s += strconv.FormatInt(report.Overhead/1024, 10) + "KB of it metadata and cache.</p>\n"
 		c.Data(http.StatusOK, "text/html", []byte(s))
 	})
 	s.GET("/htmx/blocks", func(c *gin.Context) {
@@ -153,6 +289,7 @@ func NewHTTPInstance(httpPort int, ipfsInstance *ipfs.Instance) *HTTPInstance {
 		// NOTE(Tom): Have to do this to avoid race condition
 		var blocksToSeed map[string][]int
 		var blocksSeeding map[string][]int
+		var leafCounts map[string]int
 		{
 			ipfsInstance.BlockMapsMutex.Lock()
 			defer ipfsInstance.BlockMapsMutex.Unlock()
@@ -166,11 +303,21 @@ func NewHTTPInstance(httpPort int, ipfsInstance *ipfs.Instance) *HTTPInstance {
 			for k, v := range ipfsInstance.BlocksSeeding {
 				blocksSeeding[k] = v
 			}
+
+			leafCounts = make(map[string]int, len(ipfsInstance.LeafBlocks))
+			for k, v := range ipfsInstance.LeafBlocks {
+				leafCounts[k] = len(v)
+			}
 		}
 
-		for _, source := range ipfsInstance.Sources {
+		for _, source := range ipfsInstance.SourceList() {
 			s += "<div class=\"blockcontainer\">\n"
-			for i := 0; i < int(source.BlockCount()); i++ {
+			// Nodes that haven't walked the DAG go by the source's leaf table
+			count, ok := leafCounts[source.Name]
+			if !ok {
+				count = int(source.BlockCount())
+			}
+			for i := 0; i < count; i++ {
 				class := "offblock"
 
 				for _, j := range blocksToSeed[source.Name] {
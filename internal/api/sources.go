@@ -0,0 +1,255 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ipfs/go-cid"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+// Uploads bigger than this are cut off, the storage size is checked on top of it
+const maxUploadBytes = 1 << 30
+
+// serveSource serves the file or directory at the "path" parameter of a source, the root if there's no path.
+// Files are streamed, see serveReader, directories are listed as JSON.
+func serveSource(c *gin.Context, ipfsInstance *ipfs.Instance) {
+	source, err := ipfsInstance.SourceByName(c.Param("name"))
+	if err != nil {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+
+	path := c.Param("path")
+	entry, err := ipfsInstance.Stat(c.Request.Context(), source, path)
+	if err != nil {
+		c.String(retrievalStatus(c, err), "couldn't find "+source.Name+path+": "+err.Error())
+		return
+	}
+
+	if entry.Type == ipfs.ENTRY_DIRECTORY {
+		entries, err := ipfsInstance.ListEntries(c.Request.Context(), source, path)
+		if err != nil {
+			c.String(retrievalStatus(c, err), "couldn't list "+source.Name+path+": "+err.Error())
+			return
+		}
+
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+
+	reader, err := ipfsInstance.OpenPath(c.Request.Context(), source, path)
+	if err != nil {
+		c.String(retrievalStatus(c, err), "couldn't open "+source.Name+path+": "+err.Error())
+		return
+	}
+	defer reader.Close()
+
+	serveReader(c, reader, entry.Cid, entry.Name)
+}
+
+// serveCid rebuilds the file under root and streams it, see serveReader
+func serveCid(c *gin.Context, ipfsInstance *ipfs.Instance, root cid.Cid, name string) {
+	reader, err := ipfsInstance.OpenCid(c.Request.Context(), root)
+	if err != nil {
+		c.String(retrievalStatus(c, err), "couldn't open "+root.String()+": "+err.Error())
+		return
+	}
+	defer reader.Close()
+
+	serveReader(c, reader, root.String(), name)
+}
+
+// The status code for an error coming out of retrieval
+func retrievalStatus(c *gin.Context, err error) int {
+	switch {
+	case errors.Is(err, ipfs.ErrRoleNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, ipfs.ErrPathNotFound), errors.Is(err, ipfs.ErrNotDirectory):
+		return http.StatusNotFound
+	case errors.Is(err, c.Request.Context().Err()):
+		return http.StatusRequestTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// serveReader streams a file.
+// Content-Length, range requests and conditional requests are all handled by http.ServeContent, the ETag is the file's CID.
+func serveReader(c *gin.Context, reader io.ReadSeeker, etag string, name string) {
+	c.Header("ETag", "\""+etag+"\"")
+	// Content is immutable so it can be cached forever
+	c.Header("Cache-Control", "public, max-age=29030400, immutable")
+	http.ServeContent(c.Writer, c.Request, name, time.Time{}, reader)
+}
+
+// ingestSource adds a new source from the request, either a multipart upload in the "file" field or the raw body.
+// The name comes from the "name" query parameter, falling back to the uploaded file's name.
+func ingestSource(c *gin.Context, ipfsInstance *ipfs.Instance) {
+	name := c.Query("name")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadBytes)
+	var body io.Reader = c.Request.Body
+
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		header, err := c.FormFile("file")
+		if tooLarge(err) {
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+			return
+		} else if err != nil {
+			c.String(http.StatusBadRequest, "missing file: "+err.Error())
+			return
+		}
+
+		f, err := header.Open()
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer f.Close()
+
+		body = f
+		if name == "" {
+			name = header.Filename
+		}
+	}
+
+	if name == "" {
+		c.String(http.StatusBadRequest, "missing source name")
+		return
+	}
+
+	source, err := ipfsInstance.AddSource(c.Request.Context(), name, body)
+	if errors.Is(err, ipfs.ErrSourceExists) {
+		c.String(http.StatusConflict, err.Error())
+		return
+	} else if errors.Is(err, ipfs.ErrOverQuota) || tooLarge(err) {
+		c.String(http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if errors.Is(err, ipfs.ErrRoleNotAllowed) {
+		c.String(http.StatusForbidden, err.Error())
+		return
+	} else if errors.Is(err, ipfs.ErrDraining) {
+		c.String(http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, source)
+}
+
+// True if the request body went over maxUploadBytes
+func tooLarge(err error) bool {
+	var maxBytes *http.MaxBytesError
+	return errors.As(err, &maxBytes)
+}
+
+// exportCar streams the source named by the "ref" parameter, or the DAG under it if it's a CID, as a CAR.
+// The "version" query parameter picks CARv1 or CARv2, 1 by default.
+func exportCar(c *gin.Context, ipfsInstance *ipfs.Instance) {
+	ref := c.Param("ref")
+	version, err := strconv.Atoi(c.DefaultQuery("version", "1"))
+	if err != nil || (version != 1 && version != 2) {
+		c.String(http.StatusBadRequest, ipfs.ErrCarVersion.Error())
+		return
+	}
+
+	var root cid.Cid
+	if source, err := ipfsInstance.SourceByName(ref); err == nil {
+		root, err = cid.Parse(source.Cid)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else if root, err = cid.Parse(ref); err != nil {
+		c.String(http.StatusNotFound, "no source or cid called "+ref)
+		return
+	}
+
+	// Nothing is written until the roots are found so a missing CID still gets a status
+	w := &lazyWriter{c: c, name: ref + ".car"}
+	if err := ipfsInstance.ExportCar(c.Request.Context(), root, version, w); err != nil {
+		if !w.started {
+			c.String(retrievalStatus(c, err), "couldn't export "+ref+": "+err.Error())
+			return
+		}
+		// Too late for a status, cutting the response short is all we can do
+		c.Error(err)
+		c.Abort()
+	}
+}
+
+// lazyWriter sends the CAR headers along with the first write
+type lazyWriter struct {
+	c       *gin.Context
+	name    string
+	started bool
+}
+
+func (w *lazyWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.c.Header("Content-Type", "application/vnd.ipld.car")
+		w.c.Header("Content-Disposition", "attachment; filename=\""+w.name+"\"")
+		w.c.Status(http.StatusOK)
+	}
+	return w.c.Writer.Write(p)
+}
+
+// importCar seeds the CAR in the request body, raw or a multipart upload in the "file" field, as the source in the "name" query parameter
+func importCar(c *gin.Context, ipfsInstance *ipfs.Instance) {
+	name := c.Query("name")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadBytes)
+	var body io.Reader = c.Request.Body
+
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		header, err := c.FormFile("file")
+		if tooLarge(err) {
+			c.String(http.StatusRequestEntityTooLarge, err.Error())
+			return
+		} else if err != nil {
+			c.String(http.StatusBadRequest, "missing file: "+err.Error())
+			return
+		}
+
+		f, err := header.Open()
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer f.Close()
+
+		body = f
+	}
+
+	if name == "" {
+		c.String(http.StatusBadRequest, "missing source name")
+		return
+	}
+
+	source, err := ipfsInstance.ImportCar(c.Request.Context(), name, body)
+	if errors.Is(err, ipfs.ErrCarRoot) || errors.Is(err, ipfs.ErrSourceExists) {
+		c.String(http.StatusConflict, err.Error())
+		return
+	} else if errors.Is(err, ipfs.ErrOverQuota) || tooLarge(err) {
+		c.String(http.StatusRequestEntityTooLarge, err.Error())
+		return
+	} else if errors.Is(err, ipfs.ErrRoleNotAllowed) {
+		c.String(http.StatusForbidden, err.Error())
+		return
+	} else if errors.Is(err, ipfs.ErrDraining) {
+		c.String(http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, source)
+}
@@ -0,0 +1,172 @@
+package gossip
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+// StateProvider is whatever can tell gossip what the local node looks like
+type StateProvider interface {
+	LocalState() model.NodeState
+}
+
+// DataDelegate shares every node's state through memberlist and keeps the latest version of each
+type DataDelegate struct {
+	name       string
+	provider   StateProvider
+	broadcasts *memberlist.TransmitLimitedQueue
+	states     map[string]model.NodeState // By node name
+	lastLocal  []byte                     // Last local state we broadcast, without the version
+	lock       sync.Mutex
+}
+
+// stateBroadcast is a single node state queued for gossiping
+type stateBroadcast struct {
+	name string
+	msg  []byte
+}
+
+func newDataDelegate(name string) *DataDelegate {
+	return &DataDelegate{
+		name:   name,
+		states: make(map[string]model.NodeState),
+	}
+}
+
+func (b *stateBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*stateBroadcast)
+	return ok && o.name == b.name
+}
+
+func (b *stateBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *stateBroadcast) Finished() {
+}
+
+// NodeMeta is not used, everything goes through the state
+func (d *DataDelegate) NodeMeta(limit int) []byte {
+	return []byte{}
+}
+
+// NotifyMsg receives a single node state broadcast by a peer
+func (d *DataDelegate) NotifyMsg(msg []byte) {
+	var state model.NodeState
+	if err := json.Unmarshal(msg, &state); err != nil {
+		log.Printf("Failed to decode gossip message: %s", err.Error())
+		return
+	}
+	d.merge(state)
+}
+
+// GetBroadcasts returns the queued states that fit in a packet.
+// States too big for a packet still reach everyone through push/pull.
+func (d *DataDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	if d.broadcasts == nil {
+		return nil
+	}
+	return d.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+// LocalState sends every state we know about during a push/pull sync
+func (d *DataDelegate) LocalState(join bool) []byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	states := make([]model.NodeState, 0, len(d.states))
+	for _, s := range d.states {
+		states = append(states, s)
+	}
+
+	b, err := json.Marshal(states)
+	if err != nil {
+		log.Printf("Failed to encode gossip state: %s", err.Error())
+		return nil
+	}
+	return b
+}
+
+// MergeRemoteState merges everything a peer knows about from a push/pull sync
+func (d *DataDelegate) MergeRemoteState(buf []byte, join bool) {
+	var states []model.NodeState
+	if err := json.Unmarshal(buf, &states); err != nil {
+		log.Printf("Failed to decode remote gossip state: %s", err.Error())
+		return
+	}
+	for _, s := range states {
+		d.merge(s)
+	}
+}
+
+// merge keeps the newest version of a node's state. We are the only source of truth for our own state.
+func (d *DataDelegate) merge(state model.NodeState) {
+	if state.Name == "" || state.Name == d.name {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if current, ok := d.states[state.Name]; ok && current.Version >= state.Version {
+		return
+	}
+	d.states[state.Name] = state
+}
+
+// refresh asks the provider for the local state and queues a broadcast if it changed
+func (d *DataDelegate) refresh() {
+	d.lock.Lock()
+	provider := d.provider
+	d.lock.Unlock()
+	if provider == nil {
+		return
+	}
+
+	// Not under the lock, the provider takes its own locks
+	state := provider.LocalState()
+	state.Name = d.name
+	state.Version = 0
+
+	unversioned, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Failed to encode local state: %s", err.Error())
+		return
+	}
+
+	d.lock.Lock()
+	if bytes.Equal(unversioned, d.lastLocal) {
+		d.lock.Unlock()
+		return
+	}
+	d.lastLocal = unversioned
+
+	// Use the time so a restarted node still beats its old versions
+	state.Version = time.Now().UnixNano()
+	d.states[d.name] = state
+	d.lock.Unlock()
+
+	msg, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Failed to encode local state: %s", err.Error())
+		return
+	}
+	if d.broadcasts != nil {
+		d.broadcasts.QueueBroadcast(&stateBroadcast{name: d.name, msg: msg})
+	}
+}
+
+// state returns a copy of the state known for a node
+func (d *DataDelegate) state(name string) (model.NodeState, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	s, ok := d.states[name]
+	return s, ok
+}
@@ -0,0 +1,66 @@
+package gossip
+
+import (
+	"log"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+// How many events a slow subscriber can fall behind by before it misses some
+const eventBuffer = 64
+
+// eventDelegate turns memberlist's join and leave notifications into member events for whoever subscribed
+type eventDelegate struct {
+	data        *DataDelegate
+	subscribers []chan model.MemberEvent
+	lock        sync.Mutex
+}
+
+func (e *eventDelegate) subscribe() <-chan model.MemberEvent {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	ch := make(chan model.MemberEvent, eventBuffer)
+	e.subscribers = append(e.subscribers, ch)
+	return ch
+}
+
+// memberlist holds its locks while it notifies us, so this never blocks
+func (e *eventDelegate) publish(eventType string, n *memberlist.Node, state model.NodeState) {
+	if n.Name == e.data.name {
+		return
+	}
+
+	event := model.MemberEvent{Type: eventType, Name: n.Name, State: state}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, ch := range e.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Dropped member event %s for %s, subscriber is behind", eventType, n.Name)
+		}
+	}
+}
+
+func (e *eventDelegate) NotifyJoin(n *memberlist.Node) {
+	state, _ := e.data.state(n.Name)
+	e.publish(model.MEMBER_JOINED, n, state)
+}
+
+// NotifyLeave is called for both leaving and failing.
+// memberlist doesn't pass on which one it was (n.State is still alive), a node that drained first left on purpose.
+func (e *eventDelegate) NotifyLeave(n *memberlist.Node) {
+	state, _ := e.data.state(n.Name)
+	if state.Draining {
+		e.publish(model.MEMBER_LEFT, n, state)
+	} else {
+		e.publish(model.MEMBER_FAILED, n, state)
+	}
+}
+
+func (e *eventDelegate) NotifyUpdate(n *memberlist.Node) {
+}
@@ -19,6 +19,8 @@ type Instance struct {
 	Cluster    *memberlist.Memberlist
 	Peers      []model.Peer // Known peers. Usually it's the result of the last round of health check
 	PeersLock  sync.Mutex
+	Delegate   *DataDelegate // Shares node states across the cluster
+	events     *eventDelegate
 }
 
 // NewInstance create a Gossip instance
@@ -27,24 +29,47 @@ func NewInstance(name string, gossipPort int) *Instance {
 	conf := memberlist.DefaultLocalConfig()
 	conf.BindPort = gossipPort
 	conf.Name = name
-	// TODO Add delegates for message sharing here
-	//conf.Delegate = &DataDelegate{}
+	// Full state syncs carry the holdings that don't fit in a broadcast, so do them often
+	conf.PushPullInterval = 5 * time.Second
+	delegate := newDataDelegate(name)
+	conf.Delegate = delegate
+	events := &eventDelegate{data: delegate}
+	conf.Events = events
 
 	cluster, err := memberlist.Create(conf)
 	if err != nil {
 		log.Fatalf("Failed to create gossip instance: %s", err.Error())
 	}
+	delegate.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       cluster.NumMembers,
+		RetransmitMult: conf.RetransmitMult,
+	}
 
 	return &Instance{
 		Name:       name,
 		GossipPort: gossipPort,
 		Cluster:    cluster,
 		Peers:      make([]model.Peer, 0),
+		Delegate:   delegate,
+		events:     events,
 	}
 }
 
+// Subscribe returns the joins, leaves and failures of the other members from now on
+func (i *Instance) Subscribe() <-chan model.MemberEvent {
+	return i.events.subscribe()
+}
+
+// SetStateProvider sets where the local node state shared with the cluster comes from
+func (i *Instance) SetStateProvider(p StateProvider) {
+	i.Delegate.lock.Lock()
+	defer i.Delegate.lock.Unlock()
+	i.Delegate.provider = p
+}
+
 // Start starting try to join an existing cluster via some known peers and starting health check
 func (i *Instance) Start(ctx context.Context, knownPeers []string) {
+	go i.startStateSync(ctx)
 	i.Join(ctx, knownPeers)
 	go i.startHealthCheck(ctx)
 }
@@ -54,7 +79,7 @@ func (i *Instance) Start(ctx context.Context, knownPeers []string) {
 func (i *Instance) Join(ctx context.Context, knownPeers []string) {
 	if len(knownPeers) <= 0 {
 		// TODO: Actually look for peers
-		log.Panicln("No peers defined in ENV variable. Leaving!")
+		log.Println("No peers defined in ENV variable. Starting a new cluster!")
 		return
 	}
 	// Try joining the cluster every 3 seconds
@@ -134,3 +159,39 @@ func (i *Instance) healthCheck() {
 	defer i.PeersLock.Unlock()
 	i.Peers = peers
 }
+
+// startStateSync checks the local state every second and gossips it when it changes
+func (i *Instance) startStateSync(ctx context.Context) {
+	t := time.NewTicker(1 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			i.Delegate.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ClusterState returns the latest state of every live member of the cluster, this node included
+func (i *Instance) ClusterState() []model.NodeState {
+	states := make([]model.NodeState, 0)
+	for _, m := range i.Cluster.Members() {
+		if s, ok := i.Delegate.state(m.Name); ok {
+			states = append(states, s)
+		}
+	}
+	return states
+}
+
+// Holders returns the names of the live members seeding a block of a source
+func (i *Instance) Holders(rootCid string, index int) []string {
+	holders := make([]string, 0)
+	for _, s := range i.ClusterState() {
+		if s.Holdings[rootCid].Has(index) {
+			holders = append(holders, s.Name)
+		}
+	}
+	return holders
+}
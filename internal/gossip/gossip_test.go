@@ -4,6 +4,7 @@ import (
     "context"
     "github.com/stretchr/testify/assert"
     "openmesh.network/aggregationpoc/internal/gossip"
+    "openmesh.network/aggregationpoc/internal/model"
     "testing"
     "time"
 )
@@ -11,6 +12,7 @@ import (
 func TestNewInstance(t *testing.T) {
     ins := gossip.NewInstance("Xnode-1", 9090)
     assert.NotNil(t, ins)
+    ins.Cluster.Shutdown()
 }
 
 func TestInstance_Start(t *testing.T) {
@@ -18,6 +20,8 @@ func TestInstance_Start(t *testing.T) {
     assert.NotNil(t, ins1)
     ins2 := gossip.NewInstance("Xnode-2", 9091)
     assert.NotNil(t, ins2)
+    defer ins1.Cluster.Shutdown()
+    defer ins2.Cluster.Shutdown()
     cancelCtx, cancel := context.WithCancel(context.Background())
     ins1.Start(cancelCtx, []string{})
     ins2.Start(cancelCtx, []string{"127.0.0.1:9090"})
@@ -29,6 +33,8 @@ func TestInstance_Leave(t *testing.T) {
     assert.NotNil(t, ins1)
     ins2 := gossip.NewInstance("Xnode-2", 9091)
     assert.NotNil(t, ins2)
+    defer ins1.Cluster.Shutdown()
+    defer ins2.Cluster.Shutdown()
     cancelCtx, cancel := context.WithCancel(context.Background())
     ins1.Start(cancelCtx, []string{})
     ins2.Start(cancelCtx, []string{"127.0.0.1:9090"})
@@ -42,6 +48,8 @@ func TestInstance_HealthCheck(t *testing.T) {
     assert.NotNil(t, ins1)
     ins2 := gossip.NewInstance("Xnode-2", 9091)
     assert.NotNil(t, ins2)
+    defer ins1.Cluster.Shutdown()
+    defer ins2.Cluster.Shutdown()
     cancelCtx, cancel := context.WithCancel(context.Background())
     ins1.Start(cancelCtx, []string{})
     ins2.Start(cancelCtx, []string{"127.0.0.1:9090"})
@@ -49,3 +57,95 @@ func TestInstance_HealthCheck(t *testing.T) {
     time.Sleep(7 * time.Second)
     cancel()
 }
+
+type staticState struct {
+    state model.NodeState
+}
+
+func (s *staticState) LocalState() model.NodeState {
+    return s.state
+}
+
+func TestInstance_ClusterState(t *testing.T) {
+    ins1 := gossip.NewInstance("Xnode-1", 9090)
+    ins2 := gossip.NewInstance("Xnode-2", 9091)
+    defer ins1.Cluster.Shutdown()
+    defer ins2.Cluster.Shutdown()
+
+    holdings := model.NewBitmap(10)
+    holdings.Set(3)
+    holdings.Set(7)
+    ins1.SetStateProvider(&staticState{model.NodeState{PeerID: "peer-1", Holdings: map[string]model.Bitmap{"root": holdings}}})
+    ins2.SetStateProvider(&staticState{model.NodeState{PeerID: "peer-2"}})
+
+    cancelCtx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    ins1.Start(cancelCtx, []string{})
+    ins2.Start(cancelCtx, []string{"127.0.0.1:9090"})
+
+    // Wait for the states to be refreshed and synced
+    time.Sleep(8 * time.Second)
+
+    assert.Len(t, ins2.ClusterState(), 2)
+    assert.Equal(t, []string{"Xnode-1"}, ins2.Holders("root", 3))
+    assert.Empty(t, ins2.Holders("root", 4))
+}
+
+func nextEvent(t *testing.T, events <-chan model.MemberEvent) model.MemberEvent {
+    t.Helper()
+    select {
+    case e := <-events:
+        return e
+    case <-time.After(30 * time.Second):
+        t.Fatal("no member event")
+        return model.MemberEvent{}
+    }
+}
+
+func TestInstance_Subscribe(t *testing.T) {
+    ins1 := gossip.NewInstance("Xnode-1", 9090)
+    ins2 := gossip.NewInstance("Xnode-2", 9091)
+    ins3 := gossip.NewInstance("Xnode-3", 9092)
+    defer ins1.Cluster.Shutdown()
+    defer ins2.Cluster.Shutdown()
+    defer ins3.Cluster.Shutdown()
+    events := ins1.Subscribe()
+
+    ins2.SetStateProvider(&staticState{model.NodeState{PeerID: "peer-2", Draining: true}})
+    cancelCtx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    ins1.Start(cancelCtx, []string{})
+    ins2.Start(cancelCtx, []string{"127.0.0.1:9090"})
+
+    e := nextEvent(t, events)
+    assert.Equal(t, model.MEMBER_JOINED, e.Type)
+    assert.Equal(t, "Xnode-2", e.Name)
+
+    // Wait for the draining state to get across
+    assert.Eventually(t, func() bool {
+        for _, s := range ins1.ClusterState() {
+            if s.Draining {
+                return true
+            }
+        }
+        return false
+    }, 10*time.Second, 100*time.Millisecond)
+
+    // A drained node saying goodbye left, one that stops answering failed
+    assert.Nil(t, ins2.Leave())
+    e = nextEvent(t, events)
+    assert.Equal(t, model.MEMBER_LEFT, e.Type)
+    assert.Equal(t, "Xnode-2", e.Name)
+    assert.Equal(t, "peer-2", e.State.PeerID)
+
+    _, err := ins3.Cluster.Join([]string{"127.0.0.1:9090"})
+    assert.Nil(t, err)
+    e = nextEvent(t, events)
+    assert.Equal(t, model.MEMBER_JOINED, e.Type)
+    assert.Equal(t, "Xnode-3", e.Name)
+
+    ins3.Cluster.Shutdown()
+    e = nextEvent(t, events)
+    assert.Equal(t, model.MEMBER_FAILED, e.Type)
+    assert.Equal(t, "Xnode-3", e.Name)
+}
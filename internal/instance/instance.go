@@ -2,12 +2,16 @@ package instance
 
 import (
 	"context"
+	"fmt"
 	"log"
 
+	"github.com/libp2p/go-libp2p/core/peer"
+
 	"openmesh.network/aggregationpoc/internal/api"
 	"openmesh.network/aggregationpoc/internal/gossip"
 	"openmesh.network/aggregationpoc/internal/ipfs"
 	"openmesh.network/aggregationpoc/internal/p2p"
+	"openmesh.network/aggregationpoc/internal/registry"
 )
 
 // Instance is the top-level instance of the whole poc project
@@ -19,9 +23,9 @@ type Instance struct {
 }
 
 // NewInstance create all the low-level instances, then create the top-level instance
-func NewInstance(instanceName, groupName string, gossipPort int, httpPort int, p2pPort int) *Instance {
+func NewInstance(instanceName, groupName string, gossipPort int, httpPort int, p2pPort int, ipfsConf ipfs.Config) *Instance {
 	gi := gossip.NewInstance(instanceName, gossipPort)
-	ii := ipfs.NewInstance()
+	ii := ipfs.NewInstance(ipfsConf)
 
 	h := api.NewHTTPInstance(httpPort, ii)
 
@@ -35,6 +39,35 @@ func NewInstance(instanceName, groupName string, gossipPort int, httpPort int, p
 
 	}
 
+	// Gossip shares what this node is seeding and tells ipfs what everyone else is seeding
+	gi.SetStateProvider(ii)
+	ii.Cluster = gi
+	ii.Members = gi
+
+	switch ipfsConf.Registry {
+	case registry.REGISTRY_DHT:
+		for _, id := range ipfsConf.Publishers {
+			publisher, err := peer.Decode(id)
+			if err != nil {
+				log.Printf("Ignoring bad publisher id %s: %s", id, err.Error())
+				continue
+			}
+			if pi.Sources.Publishers == nil {
+				pi.Sources.Publishers = make(map[peer.ID]bool)
+			}
+			pi.Sources.Publishers[publisher] = true
+		}
+		ii.Registry = registry.NewDHTRegistry(pi.DHT, ii.Host.Peerstore().PrivKey(ii.Host.ID()))
+	case registry.REGISTRY_GOSSIP:
+		gr := registry.NewGossipRegistry(gi)
+		gi.SetStateProvider(gr.WrapStateProvider(ii))
+		ii.Registry = gr
+	case registry.REGISTRY_FILE:
+		ii.Registry = registry.NewFileRegistry(ipfsConf.SourcesFile)
+	default:
+		panic(fmt.Errorf("unknown registry %q", ipfsConf.Registry))
+	}
+
 	return &Instance{
 		Gossip: gi,
 		HTTP:   h,
@@ -49,8 +82,8 @@ func (i *Instance) Start(ctx context.Context, gossipPeers []string, httpPeers []
 	log.Println("Running http!!")
 	i.HTTP.Start()
 
-	// NOTE(Tom): I've disabled gossip for now since I'm not using it and it crowds the logs
-	// i.Gossip.Start(ctx, gossipPeers, i.Ipfs)
+	// Joining can take a while if peers aren't up yet, don't hold up the rest
+	go i.Gossip.Start(ctx, gossipPeers)
 
 	log.Printf("Running ipfs!!\n")
 	i.Ipfs.Start(ctx, httpPeers)
@@ -0,0 +1,237 @@
+package ipfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	mrand "math/rand"
+)
+
+const (
+	ALLOCATION_RANDOM        = "random"
+	ALLOCATION_RAREST        = "rarest-first"
+	ALLOCATION_DETERMINISTIC = "deterministic"
+	ALLOCATION_RENDEZVOUS    = "rendezvous"
+)
+
+// LeafCandidate is a leaf this node could seed
+type LeafCandidate struct {
+	Source   Source
+	Index    int
+	Cid      string
+	Size     int64
+	Replicas int    // Copies held by the rest of the cluster
+	Held     bool   // Already in our blockstore
+	Stripe   string // The erasure coding stripe the leaf is in, its members go to different nodes. Empty if it isn't erasure coded
+}
+
+// AllocationStrategy decides which under replicated leaves a node claims first.
+// Keeping what's already wanted and staying within the budget is up to the allocator, so every strategy is sticky.
+type AllocationStrategy interface {
+	Name() string
+	// Order returns the candidates in the order they should be claimed, until the node runs out of space
+	Order(self string, candidates []LeafCandidate) []LeafCandidate
+}
+
+// Member is a live node that takes a share of the sources
+type Member struct {
+	PeerID   string
+	Capacity int64 // Advertised storage in bytes
+}
+
+// PlacementStrategy is a strategy that works out on its own which leaves a node keeps, whatever the rest of the cluster holds right now
+type PlacementStrategy interface {
+	AllocationStrategy
+	// Place returns the leaves self should hold out of every leaf, best first
+	Place(self string, members []Member, leaves []LeafCandidate, replicas int) []LeafCandidate
+}
+
+// NewAllocationStrategy returns the strategy with the given name
+func NewAllocationStrategy(name string) (AllocationStrategy, error) {
+	switch name {
+	case ALLOCATION_RANDOM:
+		return RandomAllocation{}, nil
+	case ALLOCATION_RAREST, "":
+		return RarestFirstAllocation{}, nil
+	case ALLOCATION_DETERMINISTIC:
+		return DeterministicAllocation{}, nil
+	case ALLOCATION_RENDEZVOUS:
+		return RendezvousAllocation{}, nil
+	default:
+		return nil, fmt.Errorf("unknown allocation strategy %q", name)
+	}
+}
+
+// RandomAllocation claims leaves in a random order
+type RandomAllocation struct{}
+
+func (RandomAllocation) Name() string {
+	return ALLOCATION_RANDOM
+}
+
+func (RandomAllocation) Order(self string, candidates []LeafCandidate) []LeafCandidate {
+	mrand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	return candidates
+}
+
+// RarestFirstAllocation claims the leaves with the fewest copies first.
+// Ties are shuffled so nodes don't all race for the same leaves.
+type RarestFirstAllocation struct{}
+
+func (RarestFirstAllocation) Name() string {
+	return ALLOCATION_RAREST
+}
+
+func (RarestFirstAllocation) Order(self string, candidates []LeafCandidate) []LeafCandidate {
+	candidates = RandomAllocation{}.Order(self, candidates)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Replicas < candidates[j].Replicas
+	})
+	return candidates
+}
+
+// DeterministicAllocation claims the leaves this node ranks lowest for first, fewest copies first.
+// Every node ranks leaves differently, so they spread out without any randomness and the same inputs always give the same result.
+type DeterministicAllocation struct{}
+
+func (DeterministicAllocation) Name() string {
+	return ALLOCATION_DETERMINISTIC
+}
+
+func (DeterministicAllocation) Order(self string, candidates []LeafCandidate) []LeafCandidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Replicas != candidates[j].Replicas {
+			return candidates[i].Replicas < candidates[j].Replicas
+		}
+		return holderRank(self, candidates[i].Cid) < holderRank(self, candidates[j].Cid)
+	})
+	return candidates
+}
+
+// RendezvousAllocation places every leaf on the members with the highest random weight for it,
+// weighted by the capacity they advertise, and keeps the leaves this node ranks in the top R for.
+// Nodes agree on who stores what without talking to each other and a member joining or leaving only moves about 1/N of the leaves.
+type RendezvousAllocation struct{}
+
+func (RendezvousAllocation) Name() string {
+	return ALLOCATION_RENDEZVOUS
+}
+
+// Order puts the leaves this node scores highest for first
+func (RendezvousAllocation) Order(self string, candidates []LeafCandidate) []LeafCandidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rendezvousScore(self, 1, candidates[i].Cid) > rendezvousScore(self, 1, candidates[j].Cid)
+	})
+	return candidates
+}
+
+// Place keeps replicas copies of every leaf, stripe members get a single copy each and are spread over as many members as there are
+func (RendezvousAllocation) Place(self string, members []Member, leaves []LeafCandidate, replicas int) []LeafCandidate {
+	placed := make([]LeafCandidate, 0)
+	scores := make(map[string]float64)
+	stripes := make(map[string][]LeafCandidate)
+
+	for _, leaf := range leaves {
+		if leaf.Stripe != "" {
+			stripes[leaf.Stripe] = append(stripes[leaf.Stripe], leaf)
+			continue
+		}
+
+		mine := 0.0
+		higher := 0
+		for _, m := range members {
+			if m.PeerID == self {
+				mine = rendezvousScore(m.PeerID, m.Capacity, leaf.Cid)
+			}
+		}
+		if mine == 0 {
+			continue
+		}
+
+		for _, m := range members {
+			if m.PeerID != self && rendezvousScore(m.PeerID, m.Capacity, leaf.Cid) > mine {
+				higher++
+			}
+		}
+		if higher < replicas {
+			placed = append(placed, leaf)
+			scores[leaf.Cid] = mine
+		}
+	}
+
+	for _, stripe := range stripes {
+		for _, leaf := range placeStripe(members, stripe) {
+			if leaf.owner == self {
+				placed = append(placed, leaf.LeafCandidate)
+				scores[leaf.Cid] = leaf.score
+			}
+		}
+	}
+
+	sort.SliceStable(placed, func(i, j int) bool {
+		return scores[placed[i].Cid] > scores[placed[j].Cid]
+	})
+	return placed
+}
+
+type placedLeaf struct {
+	LeafCandidate
+	owner string
+	score float64
+}
+
+// Gives every member of a stripe to the member that scores highest for it, without anyone taking more than their share of the stripe.
+// Members are handed out in cid order so every node comes up with the same answer.
+func placeStripe(members []Member, stripe []LeafCandidate) []placedLeaf {
+	live := 0
+	for _, m := range members {
+		if m.Capacity > 0 {
+			live++
+		}
+	}
+	if live == 0 {
+		return nil
+	}
+	limit := (len(stripe) + live - 1) / live
+
+	sorted := append([]LeafCandidate(nil), stripe...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Cid < sorted[j].Cid
+	})
+
+	load := make(map[string]int, live)
+	placed := make([]placedLeaf, 0, len(sorted))
+	for _, leaf := range sorted {
+		best := placedLeaf{LeafCandidate: leaf}
+		for _, m := range members {
+			if load[m.PeerID] >= limit {
+				continue
+			}
+			if score := rendezvousScore(m.PeerID, m.Capacity, leaf.Cid); score > best.score {
+				best.owner = m.PeerID
+				best.score = score
+			}
+		}
+
+		load[best.owner]++
+		placed = append(placed, best)
+	}
+	return placed
+}
+
+// Weighted rendezvous score of a node for a leaf: -weight / ln(h) with h uniform in (0, 1).
+// Nodes without any capacity never win.
+func rendezvousScore(peerID string, weight int64, c string) float64 {
+	if weight <= 0 {
+		return 0
+	}
+
+	sum := sha256.Sum256([]byte(peerID + "/" + c))
+	h := (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(h)
+}
@@ -0,0 +1,143 @@
+package ipfs_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+func candidates(replicas ...int) []ipfs.LeafCandidate {
+	list := make([]ipfs.LeafCandidate, len(replicas))
+	for i, r := range replicas {
+		list[i] = ipfs.LeafCandidate{Index: i, Cid: fmt.Sprintf("leaf-%d", i), Size: 1, Replicas: r}
+	}
+	return list
+}
+
+func TestNewAllocationStrategy(t *testing.T) {
+	for _, name := range []string{ipfs.ALLOCATION_RANDOM, ipfs.ALLOCATION_RAREST, ipfs.ALLOCATION_DETERMINISTIC, ipfs.ALLOCATION_RENDEZVOUS} {
+		s, err := ipfs.NewAllocationStrategy(name)
+		assert.Nil(t, err)
+		assert.Equal(t, name, s.Name())
+	}
+
+	// Rarest first is the default
+	s, err := ipfs.NewAllocationStrategy("")
+	assert.Nil(t, err)
+	assert.Equal(t, ipfs.ALLOCATION_RAREST, s.Name())
+
+	s, err = ipfs.NewAllocationStrategy("nope")
+	assert.NotNil(t, err)
+	assert.Nil(t, s)
+}
+
+func TestRarestFirstAllocation_Order(t *testing.T) {
+	ordered := ipfs.RarestFirstAllocation{}.Order("self", candidates(2, 0, 1, 0, 1))
+	for i := 1; i < len(ordered); i++ {
+		assert.LessOrEqual(t, ordered[i-1].Replicas, ordered[i].Replicas)
+	}
+}
+
+func TestDeterministicAllocation_Order(t *testing.T) {
+	a := ipfs.DeterministicAllocation{}.Order("node-a", candidates(1, 0, 1, 0, 0, 1, 0))
+	again := ipfs.DeterministicAllocation{}.Order("node-a", candidates(1, 0, 1, 0, 0, 1, 0))
+	assert.Equal(t, a, again)
+
+	for i := 1; i < len(a); i++ {
+		assert.LessOrEqual(t, a[i-1].Replicas, a[i].Replicas)
+	}
+
+	// Another node ranks the leaves differently
+	b := ipfs.DeterministicAllocation{}.Order("node-b", candidates(1, 0, 1, 0, 0, 1, 0))
+	assert.ElementsMatch(t, a, b)
+	assert.NotEqual(t, a, b)
+}
+
+func placement(members []ipfs.Member, leaves []ipfs.LeafCandidate, replicas int) map[string][]string {
+	holders := make(map[string][]string)
+	for _, m := range members {
+		for _, leaf := range (ipfs.RendezvousAllocation{}).Place(m.PeerID, members, leaves, replicas) {
+			holders[leaf.Cid] = append(holders[leaf.Cid], m.PeerID)
+		}
+	}
+	return holders
+}
+
+func TestRendezvousAllocation_Place(t *testing.T) {
+	leaves := candidates(make([]int, 1000)...)
+	members := []ipfs.Member{
+		{PeerID: "a", Capacity: 100},
+		{PeerID: "b", Capacity: 100},
+		{PeerID: "c", Capacity: 100},
+		{PeerID: "d", Capacity: 100},
+		{PeerID: "e", Capacity: 0},
+	}
+
+	// Every leaf ends up on exactly R nodes, never on one without capacity
+	before := placement(members, leaves, 2)
+	assert.Len(t, before, len(leaves))
+	for _, holders := range before {
+		assert.Len(t, holders, 2)
+		assert.NotContains(t, holders, "e")
+	}
+
+	// A fifth node joining only takes about 1/5 of the copies
+	members[4].Capacity = 100
+	after := placement(members, leaves, 2)
+	moved := 0
+	for c, holders := range after {
+		assert.Len(t, holders, 2)
+		for _, h := range holders {
+			if h == "e" {
+				moved++
+			}
+		}
+		assert.Subset(t, append(before[c], "e"), holders)
+	}
+	assert.InDelta(t, 2*len(leaves)/5, moved, float64(len(leaves))/10)
+}
+
+func TestRendezvousAllocation_Weighted(t *testing.T) {
+	leaves := candidates(make([]int, 2000)...)
+	members := []ipfs.Member{
+		{PeerID: "small", Capacity: 100},
+		{PeerID: "big", Capacity: 300},
+	}
+
+	small := len((ipfs.RendezvousAllocation{}).Place("small", members, leaves, 1))
+	big := len((ipfs.RendezvousAllocation{}).Place("big", members, leaves, 1))
+	assert.Equal(t, len(leaves), small+big)
+	assert.InDelta(t, 3.0, float64(big)/float64(small), 0.5)
+}
+
+func TestRendezvousAllocation_Stripes(t *testing.T) {
+	leaves := candidates(make([]int, 60)...)
+	for i := range leaves {
+		leaves[i].Stripe = fmt.Sprintf("source/%d", i/6)
+	}
+
+	for _, n := range []int{3, 6, 8} {
+		members := make([]ipfs.Member, n)
+		for i := range members {
+			members[i] = ipfs.Member{PeerID: fmt.Sprintf("node-%d", i), Capacity: 100}
+		}
+
+		// Every stripe member is placed once and nobody takes more than their share of a stripe
+		placed := placement(members, leaves, 2)
+		assert.Len(t, placed, len(leaves))
+		perStripe := make(map[string]int)
+		for c, holders := range placed {
+			assert.Len(t, holders, 1)
+			for _, l := range leaves {
+				if l.Cid == c {
+					perStripe[holders[0]+" "+l.Stripe]++
+				}
+			}
+		}
+		for key, count := range perStripe {
+			assert.LessOrEqual(t, count, (6+n-1)/n, key)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	bsnet "github.com/ipfs/boxo/bitswap/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+const bandwidthSpan = 10 * time.Second
+
+var ErrBadLimit = errors.New("bandwidth limits can't be negative")
+
+// BandwidthLimits caps bitswap traffic in bytes per second, 0 is no limit
+type BandwidthLimits struct {
+	Upload       int64 // Blocks we serve, over every peer
+	Download     int64 // Blocks we fetch, over every peer
+	PeerUpload   int64 // Same for every peer on its own
+	PeerDownload int64
+}
+
+// Traffic is how much bitswap sent and received
+type Traffic struct {
+	Uploaded     uint64
+	Downloaded   uint64
+	UploadRate   float64 // Bytes per second over the last few seconds
+	DownloadRate float64
+}
+
+// BandwidthStats is the current limits and throughput, overall and by peer
+type BandwidthStats struct {
+	Limits BandwidthLimits
+	Traffic
+	Peers map[string]Traffic
+}
+
+type trafficSample struct {
+	at   time.Time
+	up   int
+	down int
+}
+
+// Counts traffic and keeps the samples of the last bandwidth span
+type meter struct {
+	traffic Traffic
+	samples []trafficSample
+}
+
+func (m *meter) add(up int, down int) {
+	m.traffic.Uploaded += uint64(up)
+	m.traffic.Downloaded += uint64(down)
+	m.samples = append(m.samples, trafficSample{at: time.Now(), up: up, down: down})
+	m.prune()
+}
+
+// Drops the samples older than the bandwidth span
+func (m *meter) prune() {
+	cutoff := time.Now().Add(-bandwidthSpan)
+	i := 0
+	for i < len(m.samples) && m.samples[i].at.Before(cutoff) {
+		i++
+	}
+	m.samples = m.samples[i:]
+}
+
+func (m *meter) snapshot() Traffic {
+	m.prune()
+
+	t := m.traffic
+	up, down := 0, 0
+	for _, s := range m.samples {
+		up += s.up
+		down += s.down
+	}
+	t.UploadRate = float64(up) / bandwidthSpan.Seconds()
+	t.DownloadRate = float64(down) / bandwidthSpan.Seconds()
+	return t
+}
+
+type peerBandwidth struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+	meter    meter
+}
+
+// bandwidth shapes bitswap traffic with token buckets, one for each direction and one more for each peer
+type bandwidth struct {
+	mutex    sync.Mutex
+	limits   BandwidthLimits
+	upload   *rate.Limiter
+	download *rate.Limiter
+	meter    meter
+	peers    map[peer.ID]*peerBandwidth
+}
+
+func newBandwidth(limits BandwidthLimits) *bandwidth {
+	return &bandwidth{
+		limits:   limits,
+		upload:   newLimiter(limits.Upload),
+		download: newLimiter(limits.Download),
+		peers:    make(map[peer.ID]*peerBandwidth),
+	}
+}
+
+// A second worth of tokens, anything bigger is waited for in pieces
+func newLimiter(limit int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, 0)
+	setLimit(l, limit)
+	return l
+}
+
+func setLimit(l *rate.Limiter, limit int64) {
+	if limit <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(limit))
+	l.SetBurst(int(limit))
+}
+
+func (b *bandwidth) setLimits(limits BandwidthLimits) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.limits = limits
+	setLimit(b.upload, limits.Upload)
+	setLimit(b.download, limits.Download)
+	for _, p := range b.peers {
+		setLimit(p.upload, limits.PeerUpload)
+		setLimit(p.download, limits.PeerDownload)
+	}
+}
+
+// Has to be called with the mutex held
+func (b *bandwidth) peerLocked(p peer.ID) *peerBandwidth {
+	pb, ok := b.peers[p]
+	if !ok {
+		pb = &peerBandwidth{upload: newLimiter(b.limits.PeerUpload), download: newLimiter(b.limits.PeerDownload)}
+		b.peers[p] = pb
+	}
+	return pb
+}
+
+// Forgets a peer that went away, its traffic stays in the totals
+func (b *bandwidth) forget(p peer.ID) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.peers, p)
+}
+
+// Waits until n bytes can go to p, then counts them
+func (b *bandwidth) waitUpload(ctx context.Context, p peer.ID, n int) error {
+	b.mutex.Lock()
+	pb := b.peerLocked(p)
+	b.mutex.Unlock()
+
+	if err := waitN(ctx, b.upload, n); err != nil {
+		return err
+	}
+	if err := waitN(ctx, pb.upload, n); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	b.meter.add(n, 0)
+	pb.meter.add(n, 0)
+	b.mutex.Unlock()
+	return nil
+}
+
+// Waits until n bytes from p can be taken in, then counts them
+func (b *bandwidth) waitDownload(ctx context.Context, p peer.ID, n int) error {
+	b.mutex.Lock()
+	pb := b.peerLocked(p)
+	b.mutex.Unlock()
+
+	if err := waitN(ctx, b.download, n); err != nil {
+		return err
+	}
+	if err := waitN(ctx, pb.download, n); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	b.meter.add(0, n)
+	pb.meter.add(0, n)
+	b.mutex.Unlock()
+	return nil
+}
+
+// Takes n tokens, a burst at a time so messages bigger than a second's worth still get through
+func waitN(ctx context.Context, l *rate.Limiter, n int) error {
+	for n > 0 {
+		chunk := n
+		if l.Limit() != rate.Inf {
+			chunk = min(chunk, l.Burst())
+		}
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func (b *bandwidth) stats() BandwidthStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := BandwidthStats{Limits: b.limits, Traffic: b.meter.snapshot(), Peers: make(map[string]Traffic, len(b.peers))}
+	for p, pb := range b.peers {
+		stats.Peers[p.String()] = pb.meter.snapshot()
+	}
+	return stats
+}
+
+// BandwidthStats returns the bitswap limits and how much traffic went through, overall and by peer
+func (inst *Instance) BandwidthStats() BandwidthStats {
+	return inst.bandwidth.stats()
+}
+
+// SetBandwidthLimits changes the bitswap limits, it applies to messages that are still waiting too
+func (inst *Instance) SetBandwidthLimits(limits BandwidthLimits) error {
+	if limits.Upload < 0 || limits.Download < 0 || limits.PeerUpload < 0 || limits.PeerDownload < 0 {
+		return ErrBadLimit
+	}
+	inst.bandwidth.setLimits(limits)
+	return nil
+}
+
+// limitedNetwork is a bitswap network that holds messages back to stay within the bandwidth limits
+type limitedNetwork struct {
+	bsnet.BitSwapNetwork
+	bandwidth *bandwidth
+}
+
+// The bitswap server sends blocks through here
+func (n *limitedNetwork) SendMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) error {
+	if err := n.bandwidth.waitUpload(ctx, p, msg.Size()); err != nil {
+		return err
+	}
+	return n.BitSwapNetwork.SendMessage(ctx, p, msg)
+}
+
+// The bitswap client sends its wantlists through these
+func (n *limitedNetwork) NewMessageSender(ctx context.Context, p peer.ID, opts *bsnet.MessageSenderOpts) (bsnet.MessageSender, error) {
+	s, err := n.BitSwapNetwork.NewMessageSender(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedSender{MessageSender: s, peer: p, bandwidth: n.bandwidth}, nil
+}
+
+// The client and server both see every message, they go through one receiver so messages are only counted once
+func (n *limitedNetwork) Start(receivers ...bsnet.Receiver) {
+	n.BitSwapNetwork.Start(&limitedReceiver{receivers: receivers, bandwidth: n.bandwidth})
+}
+
+type limitedSender struct {
+	bsnet.MessageSender
+	peer      peer.ID
+	bandwidth *bandwidth
+}
+
+func (s *limitedSender) SendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
+	if err := s.bandwidth.waitUpload(ctx, s.peer, msg.Size()); err != nil {
+		return err
+	}
+	return s.MessageSender.SendMsg(ctx, msg)
+}
+
+// limitedReceiver hands incoming messages on once they fit in the download limits.
+// Messages are read off a peer's stream one at a time so holding one back slows the peer down.
+type limitedReceiver struct {
+	receivers []bsnet.Receiver
+	bandwidth *bandwidth
+}
+
+func (r *limitedReceiver) ReceiveMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) {
+	if err := r.bandwidth.waitDownload(ctx, p, msg.Size()); err != nil {
+		return
+	}
+	for _, rcv := range r.receivers {
+		rcv.ReceiveMessage(ctx, p, msg)
+	}
+}
+
+func (r *limitedReceiver) ReceiveError(err error) {
+	for _, rcv := range r.receivers {
+		rcv.ReceiveError(err)
+	}
+}
+
+func (r *limitedReceiver) PeerConnected(p peer.ID) {
+	for _, rcv := range r.receivers {
+		rcv.PeerConnected(p)
+	}
+}
+
+func (r *limitedReceiver) PeerDisconnected(p peer.ID) {
+	r.bandwidth.forget(p)
+	for _, rcv := range r.receivers {
+		rcv.PeerDisconnected(p)
+	}
+}
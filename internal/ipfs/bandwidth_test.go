@@ -0,0 +1,75 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	bsclient "github.com/ipfs/boxo/bitswap/client"
+	bsserver "github.com/ipfs/boxo/bitswap/server"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+// Runs bitswap on an instance without the rest of Start
+func startBitswap(t *testing.T, ctx context.Context, inst *ipfs.Instance) {
+	inst.Bsserver = bsserver.New(ctx, inst.Bsnetwork, inst.Bstore)
+	inst.Bsclient = bsclient.New(ctx, inst.Bsnetwork, inst.Bstore)
+	inst.Bsnetwork.Start(inst.Bsclient, inst.Bsserver)
+	inst.Bservice = blockservice.New(inst.Bstore, inst.Bsclient)
+	t.Cleanup(func() {
+		inst.Bsclient.Close()
+		inst.Bsserver.Close()
+		inst.Bsnetwork.Stop()
+	})
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	content := make([]byte, 64*1024)
+	rand.New(rand.NewSource(6)).Read(content)
+
+	seeder := offlineInstance(t)
+	_, err := seeder.AddSource(ctx, "data", bytes.NewReader(content))
+	assert.Nil(t, err)
+	leaves := seeder.LeafBlocks["data"]
+	startBitswap(t, ctx, seeder)
+
+	fetcher := offlineInstance(t)
+	startBitswap(t, ctx, fetcher)
+	assert.Nil(t, fetcher.Host.Connect(ctx, peer.AddrInfo{ID: seeder.Host.ID(), Addrs: seeder.Host.Addrs()}))
+
+	assert.ErrorIs(t, fetcher.SetBandwidthLimits(ipfs.BandwidthLimits{Download: -1}), ipfs.ErrBadLimit)
+	// Half the data in a second, the first second's worth goes through straight away
+	limits := ipfs.BandwidthLimits{PeerDownload: 32 * 1024}
+	assert.Nil(t, fetcher.SetBandwidthLimits(limits))
+
+	started := time.Now()
+	for _, leaf := range leaves {
+		_, err := fetcher.Bservice.GetBlock(ctx, leaf)
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, time.Since(started), 700*time.Millisecond)
+
+	stats := fetcher.BandwidthStats()
+	assert.Equal(t, limits, stats.Limits)
+	assert.GreaterOrEqual(t, stats.Downloaded, uint64(len(content)))
+	assert.Greater(t, stats.DownloadRate, 0.0)
+	assert.GreaterOrEqual(t, stats.Peers[seeder.Host.ID().String()].Downloaded, uint64(len(content)))
+
+	// The seeder counted the same blocks going out
+	assert.GreaterOrEqual(t, seeder.BandwidthStats().Uploaded, uint64(len(content)))
+
+	// Peers that go away are forgotten, what they sent isn't
+	assert.Nil(t, fetcher.Host.Network().ClosePeer(seeder.Host.ID()))
+	assert.Eventually(t, func() bool {
+		_, ok := fetcher.BandwidthStats().Peers[seeder.Host.ID().String()]
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, fetcher.BandwidthStats().Downloaded, uint64(len(content)))
+}
@@ -0,0 +1,295 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	format "github.com/ipfs/go-ipld-format"
+	car "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+
+	"github.com/ipfs/boxo/blockservice"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+)
+
+// How many blocks go through at once when walking or loading a DAG
+const carBatch = 64
+
+var ErrCarVersion = errors.New("car version has to be 1 or 2")
+var ErrCarRoot = errors.New("car root doesn't match the registered source")
+
+// ExportCar writes every block of the DAG under c to w as a CARv1 or a CARv2 with an index.
+// Blocks we don't hold are fetched like OpenCid does, the parity DAG of an erasure coded source goes in as a second root.
+func (inst *Instance) ExportCar(ctx context.Context, c cid.Cid, version int, w io.Writer) error {
+	if err := inst.checkRetrieval(); err != nil {
+		return err
+	}
+	if version != 1 && version != 2 {
+		return ErrCarVersion
+	}
+
+	roots := []cid.Cid{c}
+	source, _ := inst.erasureSource(c)
+	if source.Erasure != nil {
+		parity, err := cid.Parse(source.Erasure.Cid)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, parity)
+	}
+	dserv := inst.sourceDag(ctx, source)
+
+	if version == 1 {
+		return writeCar(ctx, dserv, roots, w, car.WriteAsCarV1(true))
+	}
+
+	// The CARv2 header needs the size of the data so it's put together on disk first
+	tmp, err := os.CreateTemp("", "export-*.car")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := writeCar(ctx, dserv, roots, tmp); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, tmp)
+	return err
+}
+
+// ExportSource is ExportCar for a source by name
+func (inst *Instance) ExportSource(ctx context.Context, name string, version int, w io.Writer) error {
+	source, err := inst.SourceByName(name)
+	if err != nil {
+		return err
+	}
+
+	root, err := cid.Parse(source.Cid)
+	if err != nil {
+		return err
+	}
+	return inst.ExportCar(ctx, root, version, w)
+}
+
+// The CAR header goes out as soon as the writer is made, so the roots are fetched first.
+// Nothing is written if any of them can't be found.
+func writeCar(ctx context.Context, ng format.NodeGetter, roots []cid.Cid, w io.Writer, opts ...car.Option) error {
+	if err := getBatch(ctx, ng, roots, make(map[cid.Cid]format.Node, len(roots)), metadataRetries, nil); err != nil {
+		return err
+	}
+
+	out, err := storage.NewWritable(w, roots, opts...)
+	if err != nil {
+		return err
+	}
+
+	err = walkDag(ctx, ng, roots, metadataRetries, func(nd format.Node) error {
+		return out.Put(ctx, nd.Cid().KeyString(), nd.RawData())
+	})
+	if err != nil {
+		return err
+	}
+	return out.Finalize()
+}
+
+// Visits every node under roots once, a batch at a time so they're fetched together
+func walkDag(ctx context.Context, ng format.NodeGetter, roots []cid.Cid, retries int, visit func(nd format.Node) error) error {
+	seen := cid.NewSet()
+	pending := make([]cid.Cid, 0, len(roots))
+	for _, c := range roots {
+		if seen.Visit(c) {
+			pending = append(pending, c)
+		}
+	}
+
+	for len(pending) > 0 {
+		batch := pending[:min(len(pending), carBatch)]
+		pending = pending[len(batch):]
+
+		nodes := make(map[cid.Cid]format.Node, len(batch))
+		if err := getBatch(ctx, ng, batch, nodes, retries, nil); err != nil {
+			return err
+		}
+
+		for _, c := range batch {
+			nd := nodes[c]
+			if err := visit(nd); err != nil {
+				return err
+			}
+			for _, l := range nd.Links() {
+				if seen.Visit(l.Cid) {
+					pending = append(pending, l.Cid)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ImportCar loads a CARv1 or CARv2 into the blockstore and seeds it as the source called name.
+// If the registry already has that source the CAR's root has to be its CID, otherwise it's added like an ingested source.
+// The CAR has to hold the whole DAG, the parity DAG too for erasure coded sources.
+// It's staged on disk and checked first, only the blocks of the DAG make it into the blockstore and only if it's complete.
+func (inst *Instance) ImportCar(ctx context.Context, name string, r io.Reader) (Source, error) {
+	if !inst.exchangesBlocks() {
+		return Source{}, ErrRoleNotAllowed
+	}
+	if inst.Bservice == nil {
+		return Source{}, errors.New("ipfs instance isn't started")
+	}
+	if inst.Draining() {
+		return Source{}, ErrDraining
+	}
+
+	// We keep all of it until the cluster has copies, like an ingested source
+	br, err := car.NewBlockReader(&quotaReader{r: r, limit: inst.ingestRoom()})
+	if err != nil {
+		return Source{}, err
+	}
+	if len(br.Roots) == 0 {
+		return Source{}, errors.New("car has no roots")
+	}
+	root := br.Roots[0]
+
+	source, err := inst.SourceByName(name)
+	registered := err == nil
+	if registered {
+		if source.Cid != root.String() {
+			return Source{}, fmt.Errorf("%w: %s is %s, car is %s", ErrCarRoot, name, source.Cid, root)
+		}
+	} else {
+		if !inst.canIngest() {
+			return Source{}, ErrRoleNotAllowed
+		}
+		if err := checkSourceName(name); err != nil {
+			return Source{}, err
+		}
+	}
+
+	staging, cleanup, err := stagingStore()
+	if err != nil {
+		return Source{}, err
+	}
+	defer cleanup()
+
+	// Blocks are checked against their CIDs as they're read
+	batch := make([]blocks.Block, 0, carBatch)
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Source{}, err
+		}
+
+		batch = append(batch, blk)
+		if len(batch) == carBatch {
+			if err := staging.PutMany(ctx, batch); err != nil {
+				return Source{}, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := staging.PutMany(ctx, batch); err != nil {
+		return Source{}, err
+	}
+
+	roots := []cid.Cid{root}
+	if registered && source.Erasure != nil {
+		parity, err := cid.Parse(source.Erasure.Cid)
+		if err != nil {
+			return Source{}, err
+		}
+		roots = append(roots, parity)
+	}
+
+	// Don't take in anything unless it's all here, and nothing that isn't part of the DAG
+	staged := merkledag.NewDAGService(blockservice.New(staging, offline.Exchange(staging)))
+	dag := make([]cid.Cid, 0)
+	if err := walkDag(ctx, staged, roots, 0, func(nd format.Node) error {
+		dag = append(dag, nd.Cid())
+		return nil
+	}); err != nil {
+		return Source{}, fmt.Errorf("car is missing blocks: %w", err)
+	}
+
+	// Pinned before they're written, the source's own pins take over once it's published
+	stage := inst.pins.newStage()
+	defer inst.pins.unstage(stage)
+	inst.pins.stage(stage, dag...)
+	for len(dag) > 0 {
+		batch = batch[:0]
+		for _, c := range dag[:min(len(dag), carBatch)] {
+			blk, err := staging.Get(ctx, c)
+			if err != nil {
+				return Source{}, err
+			}
+			batch = append(batch, blk)
+		}
+		dag = dag[len(batch):]
+
+		if err := inst.Bservice.AddBlocks(ctx, batch); err != nil {
+			return Source{}, err
+		}
+	}
+
+	local := merkledag.NewDAGService(blockservice.New(inst.Bstore, offline.Exchange(inst.Bstore)))
+	if !registered {
+		nd, err := local.Get(ctx, root)
+		if err != nil {
+			return Source{}, err
+		}
+		size, err := dataSize(ctx, local, nd)
+		if err != nil {
+			return Source{}, err
+		}
+
+		// Whatever chunked it isn't recorded in the CAR so the chunker is left out
+		source, err = describeSource(ctx, &pinningDAG{merkledag.NewDAGService(inst.Bservice), inst.pins, stage}, name, root, size, "", inst.Config.ErasureData, inst.Config.ErasureParity)
+		if err != nil {
+			return Source{}, err
+		}
+	}
+
+	defer inst.pinLock()()
+	if err := inst.publishSource(ctx, source); err != nil {
+		return Source{}, err
+	}
+
+	log.Println("Imported car", name, source.Cid, source.Size/1024, "KB")
+
+	inst.reallocate()
+	return source, nil
+}
+
+// An empty blockstore in a temporary directory, the returned func deletes it
+func stagingStore() (blockstore.Blockstore, func(), error) {
+	dir, err := os.MkdirTemp("", "import-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ds, err := leveldb.NewDatastore(dir, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	return blockstore.NewBlockstore(ds), func() {
+		ds.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
@@ -0,0 +1,80 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+func TestCar_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	content := make([]byte, 100*1024+7)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	from := offlineInstance(t)
+	source, err := from.AddSource(ctx, "data", bytes.NewReader(content))
+	assert.Nil(t, err)
+
+	for _, version := range []int{1, 2} {
+		buf := new(bytes.Buffer)
+		assert.Nil(t, from.ExportSource(ctx, "data", version, buf))
+
+		to := offlineInstance(t)
+		imported, err := to.ImportCar(ctx, "copy", bytes.NewReader(buf.Bytes()))
+		assert.Nil(t, err, version)
+		assert.Equal(t, source.Cid, imported.Cid)
+		assert.Equal(t, source.Size, imported.Size)
+		assert.Equal(t, source.LeafSizes, imported.LeafSizes)
+
+		r, err := to.OpenCid(ctx, cid.MustParse(imported.Cid))
+		assert.Nil(t, err)
+		data, _ := io.ReadAll(r)
+		assert.Equal(t, content, data)
+
+		// The same CAR again is fine, a different one under that name isn't
+		_, err = to.ImportCar(ctx, "copy", bytes.NewReader(buf.Bytes()))
+		assert.Nil(t, err)
+
+		other := new(bytes.Buffer)
+		name := fmt.Sprint("other-", version)
+		_, err = from.AddSource(ctx, name, bytes.NewReader(content[:5000]))
+		assert.Nil(t, err)
+		assert.Nil(t, from.ExportSource(ctx, name, version, other))
+		_, err = to.ImportCar(ctx, "copy", other)
+		assert.ErrorIs(t, err, ipfs.ErrCarRoot)
+	}
+
+	// A CAR that's missing blocks isn't seeded
+	buf := new(bytes.Buffer)
+	assert.Nil(t, from.ExportSource(ctx, "data", 1, buf))
+	cut := offlineInstance(t)
+	_, err = cut.ImportCar(ctx, "cut", bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	assert.NotNil(t, err)
+	keys, err := cut.Bstore.AllKeysChan(ctx)
+	assert.Nil(t, err)
+	for k := range keys {
+		t.Error("block from a cut car was kept:", k)
+	}
+
+	assert.ErrorIs(t, from.ExportSource(ctx, "data", 3, io.Discard), ipfs.ErrCarVersion)
+}
+
+func TestCar_ExportMissing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// Not even the header is written when the root can't be found
+	buf := new(bytes.Buffer)
+	missing := blocks.NewBlock([]byte("not in the blockstore")).Cid()
+	assert.NotNil(t, offlineInstance(t).ExportCar(ctx, missing, 1, buf))
+	assert.Equal(t, 0, buf.Len())
+}
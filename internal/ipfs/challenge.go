@@ -0,0 +1,288 @@
+package ipfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	CHALLENGE_PROTOCOL protocol.ID = "/xnode/challenge/1.0.0"
+
+	CHALLENGE_PASSED      = "passed"
+	CHALLENGE_FAILED      = "failed"      // Wrong proof, or the peer says it doesn't have the block
+	CHALLENGE_TIMEOUT     = "timeout"     // No proof within the deadline
+	CHALLENGE_UNREACHABLE = "unreachable" // Couldn't reach the peer or it never answered
+
+	challengeDeadline        = 10 * time.Second
+	challengeNonceSize       = 32
+	challengeMaxCidSize      = 128
+	defaultChallengeInterval = time.Minute
+	defaultChallengeSample   = 4
+
+	// First byte of a response
+	challengeHeld    byte = 0
+	challengeMissing byte = 1
+)
+
+// ChallengeRecord is how a peer did answering storage challenges
+type ChallengeRecord struct {
+	Passed      uint64
+	Failed      uint64
+	Timeouts    uint64
+	Unreachable uint64
+	LastResult  string // One of the CHALLENGE_ results
+	LastCid     string
+	LastLatency time.Duration
+	LastAt      time.Time
+}
+
+type challengeLog struct {
+	mutex   sync.Mutex
+	records map[string]ChallengeRecord // By peer id
+}
+
+func (l *challengeLog) record(p peer.ID, c cid.Cid, result string, latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.records == nil {
+		l.records = make(map[string]ChallengeRecord)
+	}
+
+	r := l.records[p.String()]
+	switch result {
+	case CHALLENGE_PASSED:
+		r.Passed++
+	case CHALLENGE_FAILED:
+		r.Failed++
+	case CHALLENGE_TIMEOUT:
+		r.Timeouts++
+	case CHALLENGE_UNREACHABLE:
+		r.Unreachable++
+	}
+	r.LastResult = result
+	r.LastCid = c.String()
+	r.LastLatency = latency
+	r.LastAt = time.Now()
+	l.records[p.String()] = r
+}
+
+// ChallengeResults returns how every peer we challenged did, by peer id
+func (inst *Instance) ChallengeResults() map[string]ChallengeRecord {
+	inst.challenges.mutex.Lock()
+	defer inst.challenges.mutex.Unlock()
+
+	records := make(map[string]ChallengeRecord, len(inst.challenges.records))
+	for k, v := range inst.challenges.records {
+		records[k] = v
+	}
+	return records
+}
+
+// The proof a prover has to come up with, H(nonce || block)
+func challengeProof(nonce []byte, data []byte) []byte {
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Answers a challenge from a verifier.
+// The request is a nonce and a length prefixed cid, the answer is challengeHeld and the proof or just challengeMissing.
+// Only the local blockstore is looked at, a block we'd have to fetch doesn't count as stored.
+func (inst *Instance) handleChallenge(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(challengeDeadline))
+
+	r := bufio.NewReader(s)
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		s.Reset()
+		return
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil || size > challengeMaxCidSize {
+		s.Reset()
+		return
+	}
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		s.Reset()
+		return
+	}
+	c, err := cid.Cast(raw)
+	if err != nil {
+		s.Reset()
+		return
+	}
+
+	blk, err := inst.Bstore.Get(context.Background(), c)
+	if err != nil {
+		s.Write([]byte{challengeMissing})
+		return
+	}
+	s.Write(append([]byte{challengeHeld}, challengeProof(nonce, blk.RawData())...))
+}
+
+// Challenge asks a peer to prove it stores a leaf and records the result.
+// We need the leaf ourselves to check the proof, only leaves in our own blockstore can be challenged.
+// Fetching it would get it from the peer we're challenging.
+func (inst *Instance) Challenge(ctx context.Context, p peer.ID, leaf cid.Cid) (string, error) {
+	blk, err := inst.Bstore.Get(ctx, leaf)
+	if err != nil {
+		// Not the peer's fault, nothing to record
+		return "", err
+	}
+
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	started := time.Now()
+	result := inst.sendChallenge(ctx, p, nonce, leaf, challengeProof(nonce, blk.RawData()))
+	inst.challenges.record(p, leaf, result, time.Since(started))
+	return result, nil
+}
+
+func (inst *Instance) sendChallenge(ctx context.Context, p peer.ID, nonce []byte, leaf cid.Cid, expected []byte) string {
+	cctx, cancel := context.WithTimeout(ctx, challengeDeadline)
+	defer cancel()
+
+	s, err := inst.Host.NewStream(cctx, p, CHALLENGE_PROTOCOL)
+	if err != nil {
+		return CHALLENGE_UNREACHABLE
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(challengeDeadline))
+
+	req := append([]byte(nil), nonce...)
+	req = binary.AppendUvarint(req, uint64(len(leaf.Bytes())))
+	req = append(req, leaf.Bytes()...)
+	if _, err := s.Write(req); err != nil {
+		return CHALLENGE_UNREACHABLE
+	}
+	s.CloseWrite()
+
+	// Streams are negotiated lazily, a peer that's gone or doesn't speak the protocol only shows up here
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(s, status); err != nil {
+		return challengeReadResult(err, CHALLENGE_UNREACHABLE)
+	}
+	if status[0] != challengeHeld {
+		return CHALLENGE_FAILED
+	}
+
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(s, proof); err != nil {
+		return challengeReadResult(err, CHALLENGE_FAILED)
+	}
+	if !bytes.Equal(proof, expected) {
+		return CHALLENGE_FAILED
+	}
+	return CHALLENGE_PASSED
+}
+
+// What a failed read of the answer means, running out of time is always a timeout
+func challengeReadResult(err error, otherwise string) string {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return CHALLENGE_TIMEOUT
+	}
+	return otherwise
+}
+
+// The leaves every peer says it's seeding through gossip that we hold too, by peer
+func (inst *Instance) claimedLeaves() map[peer.ID][]cid.Cid {
+	claims := make(map[peer.ID][]cid.Cid)
+	if inst.Cluster == nil {
+		return claims
+	}
+
+	inst.BlockMapsMutex.Lock()
+	leafBlocks := make(map[string][]cid.Cid, len(inst.LeafBlocks))
+	for k, v := range inst.LeafBlocks {
+		leafBlocks[k] = v
+	}
+	inst.BlockMapsMutex.Unlock()
+
+	held := inst.heldLeaves()
+	self := inst.Host.ID()
+	sources := inst.SourceList()
+	for _, state := range inst.Cluster.ClusterState() {
+		p, err := peer.Decode(state.PeerID)
+		if err != nil || p == self {
+			continue
+		}
+
+		for _, source := range sources {
+			leaves := leafBlocks[source.Name]
+			for _, i := range state.Holdings[source.Cid].Indices() {
+				if i < len(leaves) && leaves[i].Defined() && held[leaves[i].String()] {
+					claims[p] = append(claims[p], leaves[i])
+				}
+			}
+		}
+	}
+	return claims
+}
+
+// Challenges a random sample of every peer's claimed leaves
+func (inst *Instance) challengePeers(ctx context.Context) {
+	sample := inst.Config.ChallengeSample
+	if sample <= 0 {
+		sample = defaultChallengeSample
+	}
+
+	for p, leaves := range inst.claimedLeaves() {
+		mrand.Shuffle(len(leaves), func(i, j int) { leaves[i], leaves[j] = leaves[j], leaves[i] })
+		if len(leaves) > sample {
+			leaves = leaves[:sample]
+		}
+
+		for _, leaf := range leaves {
+			if ctx.Err() != nil {
+				return
+			}
+			result, err := inst.Challenge(ctx, p, leaf)
+			if err == nil && result != CHALLENGE_PASSED {
+				log.Println("Peer", p, "failed a storage challenge for", leaf, result)
+			}
+		}
+	}
+}
+
+// Challenges peers every challenge interval until ctx is done
+func (inst *Instance) runChallenges(ctx context.Context) {
+	interval := inst.Config.ChallengeInterval
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			inst.challengePeers(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
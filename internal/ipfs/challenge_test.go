@@ -0,0 +1,71 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+func TestChallenge(t *testing.T) {
+	ctx := context.Background()
+	content := make([]byte, 20*1024)
+	rand.New(rand.NewSource(3)).Read(content)
+
+	prover := offlineInstance(t)
+	_, err := prover.AddSource(ctx, "data", bytes.NewReader(content))
+	assert.Nil(t, err)
+	leaves := prover.LeafBlocks["data"]
+	assert.NotEmpty(t, leaves)
+
+	// The verifier holds the first leaf, it can't check a proof for the second
+	verifier := offlineInstance(t)
+	holdLeaves(t, prover, verifier, leaves[:1])
+	err = verifier.Host.Connect(ctx, peer.AddrInfo{ID: prover.Host.ID(), Addrs: prover.Host.Addrs()})
+	assert.Nil(t, err)
+
+	result, err := verifier.Challenge(ctx, prover.Host.ID(), leaves[0])
+	assert.Nil(t, err)
+	assert.Equal(t, ipfs.CHALLENGE_PASSED, result)
+
+	_, err = verifier.Challenge(ctx, prover.Host.ID(), leaves[1])
+	assert.NotNil(t, err)
+	has, _ := verifier.Bstore.Has(ctx, leaves[1])
+	assert.False(t, has)
+
+	// A block only the verifier has
+	missing := blocks.NewBlock([]byte("not on the prover"))
+	assert.Nil(t, verifier.Bstore.Put(ctx, missing))
+	result, err = verifier.Challenge(ctx, prover.Host.ID(), missing.Cid())
+	assert.Nil(t, err)
+	assert.Equal(t, ipfs.CHALLENGE_FAILED, result)
+
+	records := verifier.ChallengeResults()
+	record := records[prover.Host.ID().String()]
+	assert.Equal(t, uint64(1), record.Passed)
+	assert.Equal(t, uint64(1), record.Failed)
+	assert.Equal(t, ipfs.CHALLENGE_FAILED, record.LastResult)
+	assert.Equal(t, missing.Cid().String(), record.LastCid)
+
+	// Gone peers are unreachable
+	prover.Host.Close()
+	result, err = verifier.Challenge(ctx, prover.Host.ID(), leaves[0])
+	assert.Nil(t, err)
+	assert.Equal(t, ipfs.CHALLENGE_UNREACHABLE, result)
+	assert.Equal(t, uint64(1), verifier.ChallengeResults()[prover.Host.ID().String()].Unreachable)
+}
+
+// Copies leaves from one instance's blockstore to another's
+func holdLeaves(t *testing.T, from *ipfs.Instance, to *ipfs.Instance, leaves []cid.Cid) {
+	for _, c := range leaves {
+		blk, err := from.Bstore.Get(context.Background(), c)
+		assert.Nil(t, err)
+		assert.Nil(t, to.Bstore.Put(context.Background(), blk))
+	}
+}
@@ -0,0 +1,61 @@
+package ipfs
+
+import (
+	"time"
+
+	"openmesh.network/aggregationpoc/internal/model"
+	"openmesh.network/aggregationpoc/internal/registry"
+)
+
+// Config holds everything that can be tweaked about an ipfs Instance before it's created
+type Config struct {
+	Role              string        // One of ROLE_SEEDER, ROLE_STORAGE, ROLE_GATEWAY or ROLE_LIGHT
+	Datastore         string        // One of DATASTORE_MEMORY, DATASTORE_FLATFS or DATASTORE_LEVELDB
+	DataDir           string        // Where the on-disk datastores keep their files
+	ReplicationFactor int           // How many copies of each leaf the cluster aims for
+	Allocation        string        // One of the ALLOCATION_ strategies
+	Registry          string        // One of registry.REGISTRY_FILE, registry.REGISTRY_DHT or registry.REGISTRY_GOSSIP
+	SourcesFile       string        // The JSON lines file used by the file registry
+	SourcesDir        string        // The files a seeder imports and publishes on startup
+	Publishers        []string      // Peer ids allowed to sign sources in the DHT registry, anyone if empty
+	Chunker           string        // How ingested data is split into leaves, see chunker.FromString
+	ErasureData       int           // Data leaves per erasure coding stripe of the sources ingested here, 0 to store plain copies
+	ErasureParity     int           // Parity leaves per erasure coding stripe
+	HotReplicas       int           // Extra copies the cluster keeps of hot leaves, 0 to turn it off
+	HotBudget         int           // Percent of the storage size extra copies of hot leaves can take up
+	HotThreshold      int           // Requests within the access window that make a leaf hot
+	GCInterval        time.Duration // How often unpinned blocks are collected, 0 to only collect when over the storage size
+	ScrubRate         int           // Blocks re-hashed per second while scrubbing
+	ScrubInterval     time.Duration // Time between scrubs of the blockstore, 0 turns the scrubber off
+	ChallengeInterval time.Duration // How often peers are asked to prove they store what they claim, 0 to never ask
+	ChallengeSample   int           // Leaves every peer is challenged on each time
+	MinReputation     float64       // Copies on peers scoring lower than this don't count towards the replication factor, 0 to trust everyone
+	DrainTimeout      time.Duration // How long to wait for our blocks to be handed off on shutdown, 0 to leave straight away
+	FailureGrace      time.Duration // How long a failed node's copies keep counting before they're replicated again
+	Bandwidth         BandwidthLimits
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Role:              ROLE_STORAGE,
+		Datastore:         DATASTORE_FLATFS,
+		DataDir:           "data",
+		ReplicationFactor: replicationThreshold,
+		Allocation:        ALLOCATION_RAREST,
+		Registry:          registry.REGISTRY_FILE,
+		SourcesFile:       "sources.json",
+		SourcesDir:        "sources",
+		Chunker:           model.DefaultChunker,
+		HotReplicas:       1,
+		HotBudget:         10,
+		HotThreshold:      defaultHotThreshold,
+		GCInterval:        defaultGCInterval,
+		ScrubRate:         defaultScrubRate,
+		ScrubInterval:     defaultScrubInterval,
+		ChallengeInterval: defaultChallengeInterval,
+		ChallengeSample:   defaultChallengeSample,
+		MinReputation:     defaultMinReputation,
+		DrainTimeout:      defaultDrainTimeout,
+		FailureGrace:      defaultFailureGrace,
+	}
+}
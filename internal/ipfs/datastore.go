@@ -0,0 +1,141 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/mount"
+	dsync "github.com/ipfs/go-datastore/sync"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"github.com/ipfs/boxo/blockservice"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+)
+
+const (
+	DATASTORE_MEMORY  = "memory"
+	DATASTORE_FLATFS  = "flatfs"
+	DATASTORE_LEVELDB = "leveldb"
+)
+
+// Opens up the datastore backing the blockstore.
+// The flatfs option follows the same layout as kubo: blocks go into flatfs, everything else into leveldb.
+func openDatastore(conf Config) (datastore.Batching, error) {
+	switch conf.Datastore {
+	case DATASTORE_MEMORY, "":
+		return dsync.MutexWrap(datastore.NewMapDatastore()), nil
+	case DATASTORE_LEVELDB:
+		if err := os.MkdirAll(conf.DataDir, 0755); err != nil {
+			return nil, err
+		}
+
+		return leveldb.NewDatastore(filepath.Join(conf.DataDir, "datastore"), nil)
+	case DATASTORE_FLATFS:
+		if err := os.MkdirAll(conf.DataDir, 0755); err != nil {
+			return nil, err
+		}
+
+		blocks, err := flatfs.CreateOrOpen(filepath.Join(conf.DataDir, "blocks"), flatfs.NextToLast(2), false)
+		if err != nil {
+			return nil, err
+		}
+
+		rest, err := leveldb.NewDatastore(filepath.Join(conf.DataDir, "datastore"), nil)
+		if err != nil {
+			blocks.Close()
+			return nil, err
+		}
+
+		return mount.New([]mount.Mount{
+			{Prefix: datastore.NewKey("/blocks"), Datastore: blocks},
+			{Prefix: datastore.NewKey("/"), Datastore: rest},
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown datastore type %q", conf.Datastore)
+	}
+}
+
+// Loads the node's private key from the data dir, creating it on the first run.
+// Keeping it means the node keeps its peer id, and can still update the sources it signed, after a restart.
+func loadIdentity(conf Config) (crypto.PrivKey, error) {
+	if conf.Datastore == DATASTORE_MEMORY || conf.Datastore == "" {
+		priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+		return priv, err
+	}
+
+	path := filepath.Join(conf.DataDir, "identity.key")
+	if b, err := os.ReadFile(path); err == nil {
+		return crypto.UnmarshalPrivateKey(b)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(conf.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+
+	return priv, nil
+}
+
+// Walks the DAGs of a source and returns its layout.
+// Errors out instead of going to the network if a node is missing when dserv is offline.
+func collectLeaves(ctx context.Context, dserv format.NodeGetter, source Source) (dagLayout, error) {
+	return walkSource(ctx, dserv, source, 0, nil)
+}
+
+// Rebuilds LeafBlocks and BlocksSeeding from whatever is in the blockstore, without touching the network.
+// Returns true if every source's metadata was found on disk.
+func (inst *Instance) restoreFromDisk(ctx context.Context) bool {
+	dserv := merkledag.NewDAGService(blockservice.New(inst.Bstore, offline.Exchange(inst.Bstore)))
+
+	allResolved := true
+
+	inst.BlockMapsMutex.Lock()
+	defer inst.BlockMapsMutex.Unlock()
+
+	for _, source := range inst.SourceList() {
+		layout, err := collectLeaves(ctx, dserv, source)
+		if err != nil {
+			// Metadata isn't complete on disk, this source has to go through the network
+			allResolved = false
+			continue
+		}
+
+		inst.setLayout(source.Name, layout)
+		inst.metadata.resolved(source.Name, len(layout.Leaves))
+		inst.BlocksSeeding[source.Name] = make([]int, 0)
+
+		for i, leaf := range layout.Leaves {
+			if has, _ := inst.Bstore.Has(ctx, leaf); has {
+				inst.BlocksSeeding[source.Name] = append(inst.BlocksSeeding[source.Name], i)
+			}
+		}
+
+		// Keep what we had before going down
+		inst.BlocksToSeed[source.Name] = append([]int(nil), inst.BlocksSeeding[source.Name]...)
+
+		log.Println("Restored", len(inst.BlocksSeeding[source.Name]), "blocks from disk for source", source.Name)
+	}
+
+	return allResolved
+}
@@ -0,0 +1,205 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	unixfspb "github.com/ipfs/boxo/ipld/unixfs/pb"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+const (
+	ENTRY_FILE      = "file"
+	ENTRY_DIRECTORY = "directory"
+)
+
+var ErrPathNotFound = errors.New("path not found in source")
+var ErrNotDirectory = errors.New("not a directory")
+var ErrIsDirectory = errors.New("is a directory")
+
+// Entry is a file or a directory inside a source
+type Entry struct {
+	Name string
+	Cid  string
+	Type string // ENTRY_FILE or ENTRY_DIRECTORY
+	Size uint64 // The size of a file's data, or of every block under a directory
+}
+
+// ImportDirectory imports every file under dir, hidden ones aside, as a single UnixFS directory DAG and describes it as a source.
+// Files are chunked with spec and the whole tree is erasure coded if data and parity are set, see ImportSource.
+func ImportDirectory(ctx context.Context, dserv format.DAGService, name string, dir string, spec string, data int, parity int) (Source, error) {
+	root, size, err := importTree(ctx, dserv, dir, spec)
+	if err != nil {
+		return Source{}, err
+	}
+
+	return describeSource(ctx, dserv, name, root.Cid(), size, spec, data, parity)
+}
+
+// Imports a directory on disk recursively, returns its node and the bytes in its files
+func importTree(ctx context.Context, dserv format.DAGService, dir string, spec string) (format.Node, int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	d := uio.NewDirectory(dserv)
+	d.SetCidBuilder(cidBuilder)
+	total := int64(0)
+
+	for _, e := range entries {
+		if e.Name()[0] == '.' {
+			continue
+		}
+
+		var child format.Node
+		var size int64
+		path := filepath.Join(dir, e.Name())
+
+		switch {
+		case e.IsDir():
+			child, size, err = importTree(ctx, dserv, path, spec)
+		case e.Type().IsRegular():
+			child, size, err = importFile(ctx, dserv, path, spec)
+		default:
+			// Symlinks and the like aren't followed
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if err := d.AddChild(ctx, e.Name(), child); err != nil {
+			return nil, 0, err
+		}
+		total += size
+	}
+
+	nd, err := d.GetNode()
+	if err != nil {
+		return nil, 0, err
+	}
+	return nd, total, dserv.Add(ctx, nd)
+}
+
+func importFile(ctx context.Context, dserv format.DAGService, path string, spec string) (format.Node, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	counter := &countingReader{r: f}
+	c, _, err := ImportDAG(dserv, counter, spec)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nd, err := dserv.Get(ctx, c)
+	return nd, counter.n, err
+}
+
+// Describes a node as an entry called name
+func entryOf(name string, nd format.Node) (Entry, error) {
+	entry := Entry{Name: name, Cid: nd.Cid().String(), Type: ENTRY_FILE}
+
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		entry.Size = uint64(len(nd.RawData()))
+	case *merkledag.ProtoNode:
+		fsNode, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return Entry{}, err
+		}
+
+		switch fsNode.Type() {
+		case unixfspb.Data_Directory, unixfspb.Data_HAMTShard:
+			entry.Type = ENTRY_DIRECTORY
+			entry.Size, _ = nd.Size()
+		default:
+			entry.Size = fsNode.FileSize()
+		}
+	default:
+		return Entry{}, errors.New("not a UnixFS node")
+	}
+
+	return entry, nil
+}
+
+// The bytes in every file under nd, what a source made of it has as its size
+func dataSize(ctx context.Context, dserv format.DAGService, nd format.Node) (int64, error) {
+	entry, err := entryOf("", nd)
+	if err != nil {
+		return 0, err
+	}
+	if entry.Type == ENTRY_FILE {
+		return int64(entry.Size), nil
+	}
+
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return 0, err
+	}
+	links, err := dir.Links(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	total := int64(0)
+	for _, l := range links {
+		child, err := dserv.Get(ctx, l.Cid)
+		if err != nil {
+			return 0, err
+		}
+		size, err := dataSize(ctx, dserv, child)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// Follows a slash separated path from the root of a source, an empty path is the root itself
+func resolvePath(ctx context.Context, dserv format.DAGService, source Source, path string) (string, format.Node, error) {
+	root, err := cid.Parse(source.Cid)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nd, err := dserv.Get(ctx, root)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := source.Name
+	for _, part := range strings.Split(path, "/") {
+		if part == "" {
+			continue
+		}
+
+		dir, err := uio.NewDirectoryFromNode(dserv, nd)
+		if errors.Is(err, uio.ErrNotADir) {
+			return "", nil, ErrNotDirectory
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		nd, err = dir.Find(ctx, part)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil, ErrPathNotFound
+		} else if err != nil {
+			return "", nil, err
+		}
+		name = part
+	}
+
+	return name, nd, nil
+}
@@ -0,0 +1,65 @@
+package ipfs_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/blockservice"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+func TestImportDirectory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "top.txt"), []byte("top"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a", "b", "deep.bin"), make([]byte, 10000), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".hidden"), []byte("nope"), 0644))
+
+	t.Setenv("XNODE_IP", "127.0.0.1")
+	conf := ipfs.DefaultConfig()
+	conf.Datastore = ipfs.DATASTORE_MEMORY
+	inst := ipfs.NewInstance(conf)
+	defer inst.Host.Close()
+	inst.Bservice = blockservice.New(inst.Bstore, offline.Exchange(inst.Bstore))
+
+	source, err := ipfs.ImportDirectory(ctx, merkledag.NewDAGService(inst.Bservice), "dataset", dir, "size-4096", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10003), source.Size)
+	// Every file's leaves are leaves of the source
+	assert.Len(t, source.LeafSizes, 4)
+
+	entries, err := inst.ListEntries(ctx, source, "/")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "a", entries[0].Name)
+	assert.Equal(t, ipfs.ENTRY_DIRECTORY, entries[0].Type)
+	assert.Equal(t, "top.txt", entries[1].Name)
+	assert.Equal(t, ipfs.ENTRY_FILE, entries[1].Type)
+	assert.Equal(t, uint64(3), entries[1].Size)
+
+	entry, err := inst.Stat(ctx, source, "/a/b/deep.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, ipfs.Entry{Name: "deep.bin", Cid: entry.Cid, Type: ipfs.ENTRY_FILE, Size: 10000}, entry)
+
+	r, err := inst.OpenPath(ctx, source, "a/b/deep.bin")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 10000), data)
+
+	_, err = inst.OpenPath(ctx, source, "/a")
+	assert.ErrorIs(t, err, ipfs.ErrIsDirectory)
+	_, err = inst.Stat(ctx, source, "/a/missing")
+	assert.ErrorIs(t, err, ipfs.ErrPathNotFound)
+	_, err = inst.ListEntries(ctx, source, "/top.txt")
+	assert.ErrorIs(t, err, ipfs.ErrNotDirectory)
+	_, err = inst.Stat(ctx, source, "/top.txt/more")
+	assert.ErrorIs(t, err, ipfs.ErrNotDirectory)
+}
@@ -0,0 +1,147 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 5 * time.Minute
+	drainCheckInterval  = 2 * time.Second
+)
+
+var ErrDraining = errors.New("node is draining")
+
+// DrainStatus is how far handing off our blocks before leaving has got
+type DrainStatus struct {
+	Draining  bool
+	Done      bool // Every leaf we hold has enough copies elsewhere
+	Started   time.Time
+	AtRisk    int // Held leaves that would drop under the replication factor without us, when the drain started
+	Remaining int // Of those, the ones still waiting for a copy elsewhere
+	HandedOff int
+}
+
+type drainer struct {
+	mutex    sync.Mutex
+	status   DrainStatus
+	requests chan struct{}
+}
+
+func newDrainer() drainer {
+	return drainer{requests: make(chan struct{}, 1)}
+}
+
+func (d *drainer) update(f func(s *DrainStatus)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f(&d.status)
+}
+
+// DrainStatus returns a snapshot of the drain progress
+func (inst *Instance) DrainStatus() DrainStatus {
+	inst.drainer.mutex.Lock()
+	defer inst.drainer.mutex.Unlock()
+
+	return inst.drainer.status
+}
+
+// Draining is true once a drain started, there's no going back from it
+func (inst *Instance) Draining() bool {
+	return inst.DrainStatus().Draining
+}
+
+// RequestDrain asks whoever runs the node to drain it and shut it down, never blocks
+func (inst *Instance) RequestDrain() {
+	select {
+	case inst.drainer.requests <- struct{}{}:
+	default:
+	}
+}
+
+// DrainRequested fires when someone calls RequestDrain
+func (inst *Instance) DrainRequested() <-chan struct{} {
+	return inst.drainer.requests
+}
+
+// Drain gets the node ready to leave without losing data.
+// It stops taking new leaves and tells the cluster through gossip, so other nodes stop counting our copies and claim them.
+// They fetch them from us through bitswap as usual. Returns once every leaf we hold has enough copies elsewhere, or when ctx is done.
+func (inst *Instance) Drain(ctx context.Context) error {
+	first := false
+	inst.drainer.update(func(s *DrainStatus) {
+		if !s.Draining {
+			first = true
+			s.Draining = true
+			s.Started = time.Now()
+		}
+	})
+	if first {
+		log.Println("Draining, handing off our blocks")
+		// Freezes the allocation
+		inst.reallocate()
+	}
+
+	t := time.NewTicker(drainCheckInterval)
+	defer t.Stop()
+
+	for {
+		remaining := inst.leavesAtRisk()
+		inst.drainer.update(func(s *DrainStatus) {
+			// Copies can get lost while we wait, whatever is still at risk counts
+			s.AtRisk = max(s.AtRisk, remaining)
+			s.Remaining = remaining
+			s.HandedOff = s.AtRisk - remaining
+			s.Done = remaining == 0
+		})
+
+		if remaining == 0 {
+			log.Println("Drained, every block has enough copies elsewhere")
+			return nil
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			log.Println("Gave up draining with", remaining, "leaves at risk")
+			return ctx.Err()
+		}
+	}
+}
+
+// How many of the leaves we hold would have fewer copies than they need if we left now
+func (inst *Instance) leavesAtRisk() int {
+	target := inst.replicationFactor()
+
+	inst.BlockMapsMutex.Lock()
+	held := make(map[string][]string, len(inst.BlocksSeeding))
+	for name, seeding := range inst.BlocksSeeding {
+		leaves := inst.LeafBlocks[name]
+		for _, i := range seeding {
+			if i < len(leaves) && leaves[i].Defined() {
+				held[name] = append(held[name], leaves[i].String())
+			}
+		}
+	}
+	inst.BlockMapsMutex.Unlock()
+
+	// Straight from gossip, the replica set only catches up on the next heartbeat
+	holders := inst.clusterHolders()
+	atRisk := 0
+	for _, source := range inst.SourceList() {
+		copies := target
+		if source.Erasure != nil {
+			copies = 1
+		}
+
+		for _, c := range held[source.Name] {
+			if len(inst.replicas.trusted(holders[c])) < copies {
+				atRisk++
+			}
+		}
+	}
+	return atRisk
+}
@@ -0,0 +1,91 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+// A cluster view that the test changes as it goes
+type fakeCluster struct {
+	mutex  sync.Mutex
+	states []model.NodeState
+}
+
+func (f *fakeCluster) ClusterState() []model.NodeState {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]model.NodeState(nil), f.states...)
+}
+
+func (f *fakeCluster) set(states ...model.NodeState) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.states = states
+}
+
+// A peer holding every leaf of source
+func holdingAll(id string, source ipfs.Source) model.NodeState {
+	bitmap := model.NewBitmap(len(source.LeafSizes))
+	for i := range source.LeafSizes {
+		bitmap.Set(i)
+	}
+	return model.NodeState{PeerID: id, Role: ipfs.ROLE_STORAGE, Capacity: 1 << 30, Holdings: map[string]model.Bitmap{source.Cid: bitmap}}
+}
+
+func TestDrain(t *testing.T) {
+	ctx := context.Background()
+	content := make([]byte, 20*1024)
+	rand.New(rand.NewSource(5)).Read(content)
+
+	inst := offlineInstance(t)
+	cluster := &fakeCluster{}
+	inst.Cluster = cluster
+	source, err := inst.AddSource(ctx, "data", bytes.NewReader(content))
+	assert.Nil(t, err)
+	leaves := len(source.LeafSizes)
+
+	// Nobody else has a copy, so we can't leave yet
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, inst.Drain(short), context.DeadlineExceeded)
+
+	status := inst.DrainStatus()
+	assert.True(t, status.Draining)
+	assert.False(t, status.Done)
+	assert.Equal(t, leaves, status.AtRisk)
+	assert.Equal(t, leaves, status.Remaining)
+
+	// Peers learn about it through gossip and stop counting on us
+	state := inst.LocalState()
+	assert.True(t, state.Draining)
+	assert.Equal(t, int64(0), state.Capacity)
+
+	_, err = inst.AddSource(ctx, "more", bytes.NewReader(content))
+	assert.ErrorIs(t, err, ipfs.ErrDraining)
+
+	// Copies on another draining node don't count
+	draining := holdingAll("peer-a", source)
+	draining.Draining = true
+	cluster.set(draining, holdingAll("peer-b", source))
+	short, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, inst.Drain(short), context.DeadlineExceeded)
+	assert.Equal(t, leaves, inst.DrainStatus().Remaining)
+
+	// Two copies elsewhere is the default replication factor
+	cluster.set(draining, holdingAll("peer-b", source), holdingAll("peer-c", source))
+	assert.Nil(t, inst.Drain(ctx))
+
+	status = inst.DrainStatus()
+	assert.True(t, status.Done)
+	assert.Equal(t, 0, status.Remaining)
+	assert.Equal(t, leaves, status.HandedOff)
+}
@@ -0,0 +1,372 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/klauspost/reedsolomon"
+
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+// How long a leaf gets before we give up on it and rebuild it from the rest of its stripe
+const erasureFetchTimeout = 5 * time.Second
+
+// ParseErasure reads an erasure coding scheme written as data+parity, like 4+2
+func ParseErasure(scheme string) (int, int, error) {
+	data, parity, ok := strings.Cut(scheme, "+")
+	if !ok {
+		return 0, 0, fmt.Errorf("erasure scheme %q should look like data+parity", scheme)
+	}
+
+	k, err := strconv.Atoi(strings.TrimSpace(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	m, err := strconv.Atoi(strings.TrimSpace(parity))
+	if err != nil {
+		return 0, 0, err
+	}
+	if k <= 0 || m <= 0 || k+m > 256 {
+		return 0, 0, fmt.Errorf("erasure scheme %q is out of range", scheme)
+	}
+
+	return k, m, nil
+}
+
+// EncodeErasure groups the leaves under root into stripes of data leaves and works out parity parity leaves for each.
+// The parity leaves go into a DAG of their own in dserv, one stripe after the other, so they can be walked like any other source.
+func EncodeErasure(ctx context.Context, dserv format.DAGService, root cid.Cid, data int, parity int) (*model.Erasure, error) {
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := walkLeaves(ctx, dserv, root, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every member of a stripe has to be the same size, so they're all padded to the biggest leaf
+	shardSize := int64(0)
+	for i, size := range layout.LeafSizes {
+		if size < 0 {
+			nd, err := dserv.Get(ctx, layout.Leaves[i])
+			if err != nil {
+				return nil, err
+			}
+			size = int64(len(nd.RawData()))
+		}
+		if size > shardSize {
+			shardSize = size
+		}
+	}
+	if shardSize == 0 {
+		return nil, errors.New("nothing to erasure code")
+	}
+
+	erasure := &model.Erasure{Data: data, Parity: parity, ShardSize: shardSize}
+	dataLeaves := len(layout.Leaves)
+
+	pr, pw := io.Pipe()
+	go func() {
+		for stripe := 0; stripe < erasure.Stripes(dataLeaves); stripe++ {
+			shards := make([][]byte, data+parity)
+			for pos, i := range erasure.Members(stripe, dataLeaves) {
+				shards[pos] = make([]byte, shardSize)
+				if i < 0 || pos >= data {
+					continue
+				}
+
+				nd, err := dserv.Get(ctx, layout.Leaves[i])
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				copy(shards[pos], nd.RawData())
+			}
+
+			if err := enc.Encode(shards); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			for _, shard := range shards[data:] {
+				if _, err := pw.Write(shard); err != nil {
+					return
+				}
+			}
+		}
+		pw.Close()
+	}()
+
+	// Chunking at the shard size makes every parity shard a leaf of its own
+	parityRoot, _, err := ImportDAG(dserv, pr, fmt.Sprintf("size-%d", shardSize))
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return nil, err
+	}
+
+	erasure.Cid = parityRoot.String()
+	return erasure, nil
+}
+
+// Walks the DAG of a source and, if it's erasure coded, its parity DAG.
+// The parity leaves come after the data leaves so every leaf of the source has an index.
+func walkSource(ctx context.Context, ng format.NodeGetter, source Source, retries int, progress func(walked, leaves int, err error)) (dagLayout, error) {
+	root, err := cid.Parse(source.Cid)
+	if err != nil {
+		return dagLayout{}, err
+	}
+
+	layout, err := walkLeaves(ctx, ng, root, retries, progress)
+	if err != nil {
+		return dagLayout{}, err
+	}
+	for i, size := range layout.LeafSizes[:layout.DataLeaves] {
+		if size < 0 {
+			// The root is the only leaf so it's the whole source
+			layout.LeafSizes[i] = source.Size
+		}
+	}
+
+	e := source.Erasure
+	if e == nil {
+		return layout, nil
+	}
+	if e.Data <= 0 || e.Parity <= 0 {
+		return dagLayout{}, fmt.Errorf("bad erasure scheme %d+%d", e.Data, e.Parity)
+	}
+
+	parityRoot, err := cid.Parse(e.Cid)
+	if err != nil {
+		return dagLayout{}, err
+	}
+
+	walked := len(layout.Nodes)
+	parity, err := walkLeaves(ctx, ng, parityRoot, retries, func(w, leaves int, err error) {
+		if progress != nil {
+			progress(walked+w, layout.DataLeaves+leaves, err)
+		}
+	})
+	if err != nil {
+		return dagLayout{}, err
+	}
+	if len(parity.Leaves) != e.ParityLeaves(layout.DataLeaves) {
+		return dagLayout{}, fmt.Errorf("expected %d parity leaves, found %d", e.ParityLeaves(layout.DataLeaves), len(parity.Leaves))
+	}
+
+	for i, size := range parity.LeafSizes {
+		if size < 0 {
+			// A single parity leaf is the root of its DAG
+			parity.LeafSizes[i] = e.ShardSize
+		}
+	}
+
+	layout.Leaves = append(layout.Leaves, parity.Leaves...)
+	layout.LeafSizes = append(layout.LeafSizes, parity.LeafSizes...)
+	layout.Nodes = append(layout.Nodes, parity.Nodes...)
+	return layout, nil
+}
+
+// stripeGetter gets the nodes of an erasure coded source, rebuilding the data leaves nobody can hand over out of the rest of their stripe
+type stripeGetter struct {
+	ng     format.NodeGetter
+	source Source
+
+	mutex  sync.Mutex
+	layout *dagLayout
+	index  map[cid.Cid]int // data leaf -> index
+}
+
+// NewStripeGetter wraps ng so the data leaves of source that can't be fetched get rebuilt from their stripe.
+// The layout of the source is walked the first time a leaf has to be rebuilt.
+func NewStripeGetter(ng format.NodeGetter, source Source) format.NodeGetter {
+	return &stripeGetter{ng: ng, source: source}
+}
+
+// Same as NewStripeGetter with a layout we already know about
+func newStripeGetterWithLayout(ng format.NodeGetter, source Source, layout dagLayout) format.NodeGetter {
+	g := &stripeGetter{ng: ng, source: source}
+	g.setLayout(layout)
+	return g
+}
+
+// The mutex has to be held, or the getter not handed out yet
+func (g *stripeGetter) setLayout(layout dagLayout) {
+	g.layout = &layout
+	g.index = make(map[cid.Cid]int, layout.DataLeaves)
+	for i, c := range layout.Leaves[:layout.DataLeaves] {
+		g.index[c] = i
+	}
+}
+
+func (g *stripeGetter) Get(ctx context.Context, c cid.Cid) (format.Node, error) {
+	if c.Type() != cid.Raw {
+		// Only leaves can be rebuilt, everything else takes as long as it takes
+		return g.ng.Get(ctx, c)
+	}
+
+	fctx, cancel := context.WithTimeout(ctx, erasureFetchTimeout)
+	nd, err := g.ng.Get(fctx, c)
+	cancel()
+	if err == nil {
+		return nd, nil
+	}
+
+	return g.recover(ctx, c, err)
+}
+
+func (g *stripeGetter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *format.NodeOption {
+	out := make(chan *format.NodeOption, len(cids))
+
+	go func() {
+		defer close(out)
+
+		fctx, cancel := context.WithTimeout(ctx, erasureFetchTimeout)
+		got := make(map[cid.Cid]bool, len(cids))
+		for opt := range g.ng.GetMany(fctx, cids) {
+			if opt.Err != nil {
+				continue
+			}
+			got[opt.Node.Cid()] = true
+			out <- opt
+		}
+		cancel()
+
+		for _, c := range cids {
+			if got[c] {
+				continue
+			}
+			got[c] = true
+
+			nd, err := g.Get(ctx, c)
+			out <- &format.NodeOption{Node: nd, Err: err}
+		}
+	}()
+
+	return out
+}
+
+// Rebuilds a leaf we couldn't get, fetchErr is handed back if it can't be done
+func (g *stripeGetter) recover(ctx context.Context, c cid.Cid, fetchErr error) (format.Node, error) {
+	if c.Type() != cid.Raw || ctx.Err() != nil {
+		return nil, fetchErr
+	}
+
+	nd, err := g.rebuild(ctx, c)
+	if err != nil {
+		log.Println("Couldn't rebuild leaf", c, "of source", g.source.Name, ":", err)
+		return nil, fetchErr
+	}
+
+	log.Println("Rebuilt leaf", c, "of source", g.source.Name, "from its stripe")
+	return nd, nil
+}
+
+func (g *stripeGetter) dataLayout(ctx context.Context) (*dagLayout, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.layout == nil {
+		layout, err := walkSource(ctx, g.ng, g.source, metadataRetries, nil)
+		if err != nil {
+			return nil, err
+		}
+		g.setLayout(layout)
+	}
+	return g.layout, nil
+}
+
+func (g *stripeGetter) rebuild(ctx context.Context, c cid.Cid) (format.Node, error) {
+	e := g.source.Erasure
+	layout, err := g.dataLayout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mutex.Lock()
+	i, ok := g.index[c]
+	g.mutex.Unlock()
+	if !ok {
+		return nil, errors.New("not a data leaf of the source")
+	}
+
+	stripe := e.Stripe(i, layout.DataLeaves)
+	members := e.Members(stripe, layout.DataLeaves)
+
+	want := make([]cid.Cid, 0, len(members))
+	for _, j := range members {
+		if j >= 0 && j != i && j < len(layout.Leaves) {
+			want = append(want, layout.Leaves[j])
+		}
+	}
+
+	nodes := make(map[cid.Cid]format.Node, len(want))
+	fctx, cancel := context.WithTimeout(ctx, erasureFetchTimeout)
+	for opt := range g.ng.GetMany(fctx, want) {
+		if opt.Err == nil {
+			nodes[opt.Node.Cid()] = opt.Node
+		}
+	}
+	cancel()
+
+	shards := make([][]byte, len(members))
+	present := 0
+	for pos, j := range members {
+		switch {
+		case j < 0:
+			// Past the end of the data, always zeroes
+			shards[pos] = make([]byte, e.ShardSize)
+		case j == i || j >= len(layout.Leaves):
+			continue
+		default:
+			nd, ok := nodes[layout.Leaves[j]]
+			if !ok || int64(len(nd.RawData())) > e.ShardSize {
+				continue
+			}
+			shards[pos] = make([]byte, e.ShardSize)
+			copy(shards[pos], nd.RawData())
+		}
+		present++
+	}
+	if present < e.Data {
+		return nil, fmt.Errorf("only %d of the %d members of stripe %d are around, need %d", present, len(members), stripe, e.Data)
+	}
+
+	enc, err := reedsolomon.New(e.Data, e.Parity)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil, err
+	}
+
+	size := layout.LeafSizes[i]
+	if size < 0 {
+		size = g.source.Size
+	}
+	if size > e.ShardSize {
+		return nil, fmt.Errorf("leaf is %d bytes but shards are only %d", size, e.ShardSize)
+	}
+
+	data := shards[i-stripe*e.Data][:size]
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("rebuilt leaf hashes to %s", sum)
+	}
+
+	return merkledag.NewRawNodeWPrefix(data, c.Prefix())
+}
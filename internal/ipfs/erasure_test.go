@@ -0,0 +1,92 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/boxo/blockservice"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+func TestParseErasure(t *testing.T) {
+	data, parity, err := ipfs.ParseErasure("4+2")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, data)
+	assert.Equal(t, 2, parity)
+
+	for _, bad := range []string{"", "4", "4+0", "0+2", "a+b", "200+100"} {
+		_, _, err := ipfs.ParseErasure(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestErasure_Members(t *testing.T) {
+	e := model.Erasure{Data: 4, Parity: 2}
+
+	// 10 data leaves make 3 stripes, the last one only has 2 data leaves
+	assert.Equal(t, 3, e.Stripes(10))
+	assert.Equal(t, 6, e.ParityLeaves(10))
+	assert.Equal(t, []int{0, 1, 2, 3, 10, 11}, e.Members(0, 10))
+	assert.Equal(t, []int{8, 9, -1, -1, 14, 15}, e.Members(2, 10))
+	assert.Equal(t, 1, e.Stripe(5, 10))
+	assert.Equal(t, 1, e.Stripe(13, 10))
+}
+
+func TestEncodeErasure_Rebuild(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	content := make([]byte, 10*1024+300)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	root, _, err := ipfs.ImportDAG(dserv, bytes.NewReader(content), "size-1024")
+	assert.Nil(t, err)
+
+	erasure, err := ipfs.EncodeErasure(ctx, dserv, root, 4, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), erasure.ShardSize)
+	source := model.Source{Name: "test", Size: int64(len(content)), Cid: root.String(), Erasure: erasure}
+
+	read := func() ([]byte, error) {
+		getter := ipfs.NewStripeGetter(dserv, source)
+		nd, err := getter.Get(ctx, root)
+		if err != nil {
+			return nil, err
+		}
+		r, err := uio.NewDagReader(ctx, nd, merkledag.NewReadOnlyDagService(getter))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+
+	nd, err := dserv.Get(ctx, root)
+	assert.Nil(t, err)
+	leaves := nd.Links()
+	assert.Len(t, leaves, 11)
+
+	// Two data leaves out of the first stripe and one out of the last, which is short of data leaves
+	for _, i := range []int{0, 3, 9} {
+		assert.Nil(t, bs.DeleteBlock(ctx, leaves[i].Cid))
+	}
+	got, err := read()
+	assert.Nil(t, err)
+	assert.Equal(t, content, got)
+
+	// Three members of the first stripe are one too many
+	assert.Nil(t, bs.DeleteBlock(ctx, leaves[1].Cid))
+	_, err = read()
+	assert.NotNil(t, err)
+}
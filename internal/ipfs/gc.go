@@ -0,0 +1,266 @@
+package ipfs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+
+	"github.com/ipfs/boxo/blockservice"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+)
+
+const (
+	GC_SCHEDULE = "schedule"
+	GC_QUOTA    = "quota"
+	GC_REMOVED  = "removed"
+	GC_MANUAL   = "manual"
+	GC_CACHE    = "cache"
+
+	defaultGCInterval  = 10 * time.Minute
+	quotaCheckInterval = 30 * time.Second
+)
+
+// GCReport is what a garbage collection did
+type GCReport struct {
+	Trigger    string // One of the GC_ triggers
+	Started    time.Time
+	Duration   time.Duration
+	Kept       int // Blocks something pins
+	Removed    int
+	FreedBytes int64
+	Failed     int // Unpinned blocks that couldn't be deleted
+}
+
+// garbageCollector serializes collections and remembers the last one
+type garbageCollector struct {
+	// Collections take it for writing, ingests take it for reading while they swap their staged pins for the source's
+	lock  sync.RWMutex
+	mutex sync.Mutex
+	last  GCReport
+}
+
+// Keeps the GC from running while an ingest publishes its source, call the returned func once it's done
+func (inst *Instance) pinLock() func() {
+	inst.gc.lock.RLock()
+	return inst.gc.lock.RUnlock
+}
+
+// LastGC returns the report of the last garbage collection, zero if there hasn't been one
+func (inst *Instance) LastGC() GCReport {
+	inst.gc.mutex.Lock()
+	defer inst.gc.mutex.Unlock()
+
+	return inst.gc.last
+}
+
+// CollectGarbage deletes every block in the blockstore that no pin set keeps.
+//  1. List the blockstore. Anything written after this isn't looked at, so nodes fetched from the top of a DAG down are safe.
+//  2. Mark every node with links under a recursive pin that we hold.
+//  3. With the block maps locked so allocation and sync can't change what's wanted, mark the directly pinned leaves,
+//     delete whatever was listed and isn't marked, and stop saying we seed the leaves that went.
+func (inst *Instance) CollectGarbage(ctx context.Context, trigger string) (GCReport, error) {
+	inst.gc.lock.Lock()
+	defer inst.gc.lock.Unlock()
+
+	report := GCReport{Trigger: trigger, Started: time.Now()}
+
+	keys, err := inst.Bstore.AllKeysChan(ctx)
+	if err != nil {
+		return report, err
+	}
+	listed := make([]cid.Cid, 0)
+	for c := range keys {
+		listed = append(listed, c)
+	}
+	if ctx.Err() != nil {
+		return report, ctx.Err()
+	}
+
+	marked, err := inst.markRecursive(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	sizes := inst.accountant.snapshot()
+	deleted := make(map[string]bool)
+
+	inst.BlockMapsMutex.Lock()
+	inst.pinAllocatedLocked()
+	inst.markDirect(marked)
+	for _, c := range listed {
+		h := string(c.Hash())
+		if marked[h] {
+			report.Kept++
+			continue
+		}
+
+		if err := inst.Bstore.DeleteBlock(ctx, c); err != nil {
+			report.Failed++
+			continue
+		}
+		deleted[h] = true
+		report.Removed++
+		report.FreedBytes += sizes[h]
+	}
+	inst.dropDeletedLocked(deleted)
+	inst.BlockMapsMutex.Unlock()
+	report.Duration = time.Since(report.Started)
+
+	inst.syncer.update(func(s *SyncStats) { s.Evicted += uint64(report.Removed) })
+	inst.gc.mutex.Lock()
+	inst.gc.last = report
+	inst.gc.mutex.Unlock()
+
+	log.Println("GC", trigger, "removed", report.Removed, "blocks,", report.FreedBytes/1024, "KB freed,", report.Kept, "kept")
+	return report, nil
+}
+
+// Takes the leaves that were deleted out of BlocksSeeding so the sync engine fetches them again if they're wanted,
+// has to be called with BlockMapsMutex held
+func (inst *Instance) dropDeletedLocked(deleted map[string]bool) {
+	if len(deleted) == 0 {
+		return
+	}
+
+	for name, seeding := range inst.BlocksSeeding {
+		leaves := inst.LeafBlocks[name]
+		held := seeding[:0:0]
+		for _, i := range seeding {
+			if i < len(leaves) && leaves[i].Defined() && deleted[string(leaves[i].Hash())] {
+				continue
+			}
+			held = append(held, i)
+		}
+		inst.BlocksSeeding[name] = held
+	}
+}
+
+// Works out which blocks the pin sets keep, by multihash like the blockstore keys them
+func (inst *Instance) markPinned(ctx context.Context) (map[string]bool, error) {
+	marked, err := inst.markRecursive(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	inst.markDirect(marked)
+	return marked, nil
+}
+
+// Marks the directly pinned leaves and everything ingests are writing
+func (inst *Instance) markDirect(marked map[string]bool) {
+	for _, set := range inst.pins.snapshot() {
+		for _, c := range set.Direct {
+			marked[string(c.Hash())] = true
+		}
+	}
+	for _, c := range inst.pins.stagedSnapshot() {
+		marked[string(c.Hash())] = true
+	}
+}
+
+// Marks every node with links under a recursive pin, the leaves under them aren't
+func (inst *Instance) markRecursive(ctx context.Context) (map[string]bool, error) {
+	marked := make(map[string]bool)
+
+	pending := make([]cid.Cid, 0)
+	for _, set := range inst.pins.snapshot() {
+		pending = append(pending, set.Recursive...)
+	}
+
+	local := merkledag.NewDAGService(blockservice.New(inst.Bstore, offline.Exchange(inst.Bstore)))
+	seen := cid.NewSet()
+	for len(pending) > 0 {
+		c := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		// Raw blocks are always leaves, no need to read them
+		if !seen.Visit(c) || c.Prefix().Codec == cid.Raw {
+			continue
+		}
+
+		nd, err := local.Get(ctx, c)
+		if format.IsNotFound(err) {
+			// Not fetched yet, nothing to keep under it either
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(nd.Links()) == 0 {
+			// A leaf, only kept if it's pinned directly
+			continue
+		}
+
+		marked[string(c.Hash())] = true
+		for _, l := range nd.Links() {
+			pending = append(pending, l.Cid)
+		}
+	}
+
+	return marked, nil
+}
+
+// Collects if the blockstore holds more than the storage size
+func (inst *Instance) collectIfOverQuota(ctx context.Context) {
+	report := inst.StorageReport()
+	if report.Used <= report.Quota {
+		return
+	}
+
+	if _, err := inst.CollectGarbage(ctx, GC_QUOTA); err != nil {
+		log.Println("GC failed:", err)
+	}
+}
+
+// Collects if there's any cache, so the allocation can count on the space it takes up
+func (inst *Instance) collectCache(ctx context.Context) {
+	if inst.StorageReport().Cache == 0 {
+		return
+	}
+
+	if _, err := inst.CollectGarbage(ctx, GC_CACHE); err != nil {
+		log.Println("GC failed:", err)
+	}
+}
+
+// Collects every GC interval until ctx is done
+func (inst *Instance) runGC(ctx context.Context) {
+	interval := inst.Config.GCInterval
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if _, err := inst.CollectGarbage(ctx, GC_SCHEDULE); err != nil {
+				log.Println("GC failed:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Keeps what a gateway caches within the storage size, there's no sync loop to do it
+func (inst *Instance) runCacheEviction(ctx context.Context) {
+	t := time.NewTicker(quotaCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			inst.collectIfOverQuota(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	inst := offlineInstance(t)
+
+	content := make([]byte, 6*4096)
+	rand.New(rand.NewSource(1)).Read(content)
+	_, err := inst.AddSource(ctx, "a", bytes.NewReader(content[:4*4096]))
+	assert.Nil(t, err)
+	// b shares its first four leaves with a
+	_, err = inst.AddSource(ctx, "b", bytes.NewReader(content))
+	assert.Nil(t, err)
+
+	pins := inst.Pins()
+	assert.Len(t, pins["a"].Recursive, 1)
+	assert.Len(t, pins["a"].Direct, 4)
+	assert.Len(t, pins["b"].Direct, 6)
+
+	// Something fetched for a retrieval that nothing pins
+	cached := blocks.NewBlock(content[100:200])
+	assert.Nil(t, inst.Bstore.Put(ctx, cached))
+
+	report, err := inst.CollectGarbage(ctx, ipfs.GC_MANUAL)
+	assert.Nil(t, err)
+	assert.Equal(t, ipfs.GC_MANUAL, report.Trigger)
+	assert.Equal(t, 1, report.Removed)
+	assert.Equal(t, int64(100), report.FreedBytes)
+	assert.Equal(t, report, inst.LastGC())
+	has, _ := inst.Bstore.Has(ctx, cached.Cid())
+	assert.False(t, has)
+
+	assert.Nil(t, inst.RemoveSource(ctx, "a"))
+	_, err = inst.CollectGarbage(ctx, ipfs.GC_MANUAL)
+	assert.Nil(t, err)
+
+	// a's root goes, the leaves b pins stay
+	has, _ = inst.Bstore.Has(ctx, pins["a"].Recursive[0])
+	assert.False(t, has)
+	for _, c := range append(pins["b"].Recursive, pins["b"].Direct...) {
+		has, _ := inst.Bstore.Has(ctx, c)
+		assert.True(t, has, c.String())
+	}
+	_, ok := inst.Pins()["a"]
+	assert.False(t, ok)
+
+	// Nothing left once nothing pins anything
+	assert.Nil(t, inst.RemoveSource(ctx, "b"))
+	_, err = inst.CollectGarbage(ctx, ipfs.GC_MANUAL)
+	assert.Nil(t, err)
+	keys, err := inst.Bstore.AllKeysChan(ctx)
+	assert.Nil(t, err)
+	for c := range keys {
+		t.Error("block left behind", c)
+	}
+}
+
+func TestCollectGarbage_DropsHeld(t *testing.T) {
+	ctx := context.Background()
+	inst := offlineInstance(t)
+
+	content := make([]byte, 4*4096)
+	rand.New(rand.NewSource(1)).Read(content)
+	_, err := inst.AddSource(ctx, "a", bytes.NewReader(content))
+	assert.Nil(t, err)
+	leaves := inst.Pins()["a"].Direct
+
+	// The allocation let go of two leaves the sync engine hasn't released yet
+	inst.BlockMapsMutex.Lock()
+	inst.BlocksToSeed["a"] = []int{0, 1}
+	inst.BlockMapsMutex.Unlock()
+
+	report, err := inst.CollectGarbage(ctx, ipfs.GC_MANUAL)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Removed)
+
+	// Nobody says they're seeding a leaf that's gone
+	inst.BlockMapsMutex.Lock()
+	assert.Equal(t, []int{0, 1}, inst.BlocksSeeding["a"])
+	inst.BlockMapsMutex.Unlock()
+	for i, c := range leaves {
+		has, _ := inst.Bstore.Has(ctx, c)
+		assert.Equal(t, i < 2, has, i)
+	}
+}
@@ -1,25 +1,18 @@
 package ipfs
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
-	mrand "math/rand"
-
 	"github.com/ipfs/go-datastore"
-	dsync "github.com/ipfs/go-datastore/sync"
-	format "github.com/ipfs/go-ipld-format"
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
@@ -27,6 +20,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/peer"
 
 	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
 
 	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multicodec"
@@ -46,15 +40,20 @@ import (
 	bsclient "github.com/ipfs/boxo/bitswap/client"
 	bsnet "github.com/ipfs/boxo/bitswap/network"
 	bsserver "github.com/ipfs/boxo/bitswap/server"
+
+	"openmesh.network/aggregationpoc/internal/model"
+	"openmesh.network/aggregationpoc/internal/registry"
 )
 
 const DEFAULT_STORAGE_BYTES = 20 * 1024 * 1024
-const DEFAULT_BLOCK_SIZE = 128 * 1024
 
-type Source struct {
-	Name string
-	Size int64
-	Cid  string // an id to the ROOT
+type Source = model.Source
+
+// Every DAG node we make is CIDv1 with sha2-256
+var cidBuilder = cid.V1Builder{
+	Codec:    uint64(multicodec.DagPb),
+	MhType:   uint64(multicodec.Sha2_256),
+	MhLength: -1,
 }
 
 // TODO: give this a better name
@@ -67,10 +66,13 @@ const (
 	ADJUSTING_WANTED_BLOCKS
 	DOWNLOADING_BLOCKS
 	SEEDING_BLOCKS
+	SERVING_GATEWAY
+	OBSERVING
 )
 
 type Instance struct {
-	CapacityInBytes   uint
+	Config            Config
+	Datastore         datastore.Batching
 	Bservice          blockservice.BlockService
 	Bstore            blockstore.Blockstore
 	Bsnetwork         bsnet.BitSwapNetwork
@@ -79,44 +81,42 @@ type Instance struct {
 	Host              host.Host
 	PeersBacklog      []string
 	PeersBacklogMutex sync.Mutex
+	Registry          registry.Registry  // Where the list of sources comes from
+	Allocator         AllocationStrategy // Picks which under replicated leaves to claim first
 	Sources           []Source
-	StorageSize       int
+	SourcesMutex      sync.Mutex
 	Status            Status
 
 	LeafBlocks     map[string][]cid.Cid // leaves in the IPFS tree, which means blocks that store raw data
 	BlocksToSeed   map[string][]int
 	BlocksSeeding  map[string][]int
 	BlockMapsMutex sync.Mutex
-}
 
-func blocksInSize(size int64) int64 {
-	blockCount := int64(size) / (DEFAULT_BLOCK_SIZE)
-	// blocks HAVE to fit the data so if they don't divide nicelly, we need an extra chunk to fit the data
-	if size < DEFAULT_BLOCK_SIZE && size > 0 {
-		blockCount = 1
-	} else if size%int64(DEFAULT_BLOCK_SIZE) != 0 && size > int64(DEFAULT_BLOCK_SIZE) {
-		blockCount += 1
-	}
-
-	return blockCount
-}
-
-func (s *Source) BlockCount() int64 {
-	return blocksInSize(s.Size)
-}
-
-func (s *Source) BlockSize(index int) (int64, error) {
-	blocksCount := blocksInSize(s.Size)
-	if int64(index) > blocksCount-1 {
-		return 0, errors.New("Index out of range")
-	} else {
-		if index == int(blocksCount)-1 {
-			// size is remainder
-			return (s.Size) - ((blocksCount - 1) * (DEFAULT_BLOCK_SIZE)), nil
-		} else {
-			return DEFAULT_BLOCK_SIZE, nil
-		}
-	}
+	storageSize  int        // bytes this node is willing to store, see SetStorageSize
+	storageMutex sync.Mutex // the sync loop and the allocation read the storage size while the API changes it
+
+	layouts    map[string]dagLayout // the DAG of every resolved source, by name
+	accountant *accountant          // counts the bytes in the blockstore
+	metadata   metadataTracker      // how far along resolving the leaves of every source is
+	syncer     syncEngine           // fetches and evicts blocks to match BlocksToSeed
+	access     *AccessTracker       // how often every block gets requested
+	pins       *pinner              // what the GC has to keep, by source
+	gc         garbageCollector
+	scrubber   scrubber     // re-hashes stored blocks to catch corruption
+	challenges challengeLog // how peers did proving they store what they claim
+	reputation *reputation  // what we think of every peer
+	drainer    drainer      // handing our blocks off before we leave
+	bandwidth  *bandwidth   // keeps bitswap within the bandwidth limits
+
+	Cluster           ClusterView      // The rest of the cluster, nil if gossip isn't running
+	Members           MembershipEvents // Nodes joining and failing, nil if gossip isn't running
+	departed          departures       // failed nodes whose copies still count for a while
+	replicas          replicaSet       // what the rest of the cluster is seeding
+	origins           map[string]bool  // sources ingested here, we keep them until the cluster has enough copies
+	needsReallocation bool
+	reallocateMutex   sync.Mutex
+	cancel            context.CancelFunc // stops everything Start started
+	running           sync.WaitGroup     // everything Start started, Stop waits for it before closing the datastore
 }
 
 func HostToString(h host.Host) string {
@@ -126,19 +126,7 @@ func HostToString(h host.Host) string {
 	return addr.Encapsulate(hostAddr).String()
 }
 
-func makeHost(listenPort int, randseed int64) (host.Host, error) {
-	var r io.Reader
-	if randseed == 0 {
-		r = rand.Reader
-	} else {
-		r = mrand.New(mrand.NewSource(randseed))
-	}
-
-	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
-	if err != nil {
-		return nil, err
-	}
-
+func makeHost(listenPort int, priv crypto.PrivKey) (host.Host, error) {
 	opts := []libp2p.Option{
 		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/%s/tcp/%d", os.Getenv("XNODE_IP"), listenPort)),
 		libp2p.Identity(priv),
@@ -147,77 +135,99 @@ func makeHost(listenPort int, randseed int64) (host.Host, error) {
 	return libp2p.New(opts...)
 }
 
-// This runs the seed server, which will read all sources in the sources directory and seed them forever
+// This runs the seed server, which will read all sources in the sources directory, publish them and seed them forever.
+// A file that can't be imported is skipped, the rest are still seeded.
 func (inst *Instance) runSeedServer(ctx context.Context) {
-	entries, err := os.ReadDir("sources")
-
+	entries, err := os.ReadDir(inst.Config.SourcesDir)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Couldn't read the sources directory:", err)
+		return
 	}
 
 	inst.Status = GETTING_METADATA
 
 	for _, e := range entries {
+		if ctx.Err() != nil {
+			return
+		}
 
-		f, _ := e.Info()
-
-		if !f.IsDir() {
-			if f.Name()[0] != '.' && f.Size() > 0 {
-				fmt.Println(e.Name())
-
-				inst.BlocksToSeed[f.Name()] = make([]int, blocksInSize(int64(f.Size())))
-				for i := 0; i < int(blocksInSize(int64(f.Size()))); i++ {
-					inst.BlocksToSeed[f.Name()][i] = i
-				}
-
-				c, size, err := inst.seedFile("./sources/" + f.Name())
+		f, err := e.Info()
+		if err != nil {
+			log.Println("Skipping", e.Name(), err)
+			continue
+		}
 
-				inst.BlocksSeeding[f.Name()] = make([]int, blocksInSize(int64(size)))
-				for i := 0; i < int(blocksInSize(int64(size))); i++ {
-					inst.BlocksSeeding[f.Name()][i] = i
-				}
+		// Hidden files and empty files are skipped, directories become a single source
+		if f.Name()[0] == '.' || (!f.IsDir() && f.Size() == 0) {
+			continue
+		}
 
-				fmt.Println("Now seeding", c, "", size/1024, "KB")
+		fmt.Println(e.Name())
 
-				if err != nil {
-					panic(err)
-				}
-			}
+		source, err := inst.seedEntry(ctx, filepath.Join(inst.Config.SourcesDir, f.Name()), f.IsDir())
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.Println("Failed to seed", f.Name(), err)
+			continue
 		}
+
+		fmt.Println("Now seeding", source.Cid, "", source.Size/1024, "KB")
 	}
 
 	inst.Status = SEEDING_BLOCKS
+}
 
-	n := bsnet.NewFromIpfsHost(inst.Host, routinghelpers.Null{})
-	inst.Bsserver = bsserver.New(ctx, inst.Bsnetwork, inst.Bstore)
+// Imports a file or directory from the sources directory and publishes it
+func (inst *Instance) seedEntry(ctx context.Context, path string, dir bool) (Source, error) {
+	stage := inst.pins.newStage()
+	defer inst.pins.unstage(stage)
 
-	n.Start(inst.Bsserver)
+	var source Source
+	var err error
+	if dir {
+		source, err = inst.importDirectory(ctx, path, stage)
+	} else {
+		source, err = inst.seedFile(ctx, path, stage)
+	}
+	if err != nil {
+		return Source{}, err
+	}
+
+	defer inst.pinLock()()
+	if err := inst.publishSource(ctx, source); err != nil {
+		return Source{}, err
+	}
+	return source, nil
 }
 
 // Reads a file and seeds it on IPFS
-func (inst *Instance) seedFile(filename string) (cid.Cid, uint64, error) {
+func (inst *Instance) seedFile(ctx context.Context, filename string, stage int) (Source, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return Source{}, err
+	}
+	defer f.Close()
 
-	fileBytes, err := os.ReadFile(filename)
+	return inst.importSource(ctx, filepath.Base(filename), f, stage)
+}
+
+// ImportDAG chunks r with the chunker described by spec (see chunker.FromString),
+// arranges the leaves into a balanced UnixFS DAG and adds it to dserv
+func ImportDAG(dserv format.DAGService, r io.Reader, spec string) (cid.Cid, uint64, error) {
+	splitter, err := chunker.FromString(r, spec)
 	if err != nil {
 		return cid.Undef, 0, err
 	}
-	fileReader := bytes.NewReader(fileBytes)
-
-	// NOTE Might have to change this... it used to use an offline blockservice which could be the correct approach here
-	dsrv := merkledag.NewDAGService(inst.Bservice)
 
 	ufsImportParams := uih.DagBuilderParams{
-		Maxlinks:  uih.DefaultLinksPerBlock,
-		RawLeaves: true,
-		CidBuilder: cid.V1Builder{
-			Codec:    uint64(multicodec.DagPb),
-			MhType:   uint64(multicodec.Sha2_256),
-			MhLength: -1,
-		},
-		Dagserv: dsrv,
-		NoCopy:  false,
+		Maxlinks:   uih.DefaultLinksPerBlock,
+		RawLeaves:  true,
+		CidBuilder: cidBuilder,
+		Dagserv:    dserv,
+		NoCopy:     false,
 	}
-	ufsBuilder, err := ufsImportParams.New(chunker.NewSizeSplitter(fileReader, DEFAULT_BLOCK_SIZE))
+	ufsBuilder, err := ufsImportParams.New(splitter)
 	if err != nil {
 		return cid.Undef, 0, err
 	}
@@ -230,14 +240,20 @@ func (inst *Instance) seedFile(filename string) (cid.Cid, uint64, error) {
 	return nd.Cid(), size, nil
 }
 
-func NewInstance() *Instance {
+func NewInstance(conf Config) *Instance {
 	// Max storage
-	h, err := makeHost(0, mrand.Int63())
+	priv, err := loadIdentity(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	h, err := makeHost(0, priv)
 	if err != nil {
 		panic(err)
 	}
 
 	inst := &Instance{
+		Config:            conf,
 		Bservice:          nil,
 		Bstore:            nil,
 		Host:              h,
@@ -245,160 +261,115 @@ func NewInstance() *Instance {
 		PeersBacklogMutex: sync.Mutex{},
 	}
 
-	{ // Open up sources.json and work some stuff out
-		bytes, err := os.ReadFile("sources.json")
-		if err != nil {
-			panic(err)
-		}
+	// Sources come from the registry once we start
+	inst.Sources = make([]Source, 0)
+	inst.BlocksToSeed = make(map[string][]int)
+	inst.BlocksSeeding = make(map[string][]int)
+	inst.LeafBlocks = make(map[string][]cid.Cid)
+	inst.layouts = make(map[string]dagLayout)
+	inst.origins = make(map[string]bool)
+	inst.storageSize = DEFAULT_STORAGE_BYTES
+	inst.syncer = newSyncEngine()
+	inst.access = NewAccessTracker(accessWindow, accessBuckets)
+	inst.pins = newPinner()
+	inst.reputation = newReputation()
+	inst.drainer = newDrainer()
+	inst.bandwidth = newBandwidth(conf.Bandwidth)
+	inst.Host.SetStreamHandler(CHALLENGE_PROTOCOL, inst.handleChallenge)
+
+	if !validRole(inst.Role()) {
+		panic(fmt.Errorf("unknown role %q", conf.Role))
+	}
 
-		lines := strings.Split(string(bytes), "\n")
-		inst.Sources = make([]Source, len(lines))
-		inst.BlocksToSeed = make(map[string][]int, len(inst.Sources))
-		inst.BlocksSeeding = make(map[string][]int, len(inst.Sources))
-		inst.LeafBlocks = make(map[string][]cid.Cid, len(inst.Sources))
-		inst.StorageSize = DEFAULT_STORAGE_BYTES
-
-		for i := range lines {
-			err = json.Unmarshal([]byte(lines[i]), &inst.Sources[i])
-			if err != nil {
-				panic(err)
-			}
+	inst.Allocator, err = NewAllocationStrategy(conf.Allocation)
+	if err != nil {
+		panic(err)
+	}
 
-			inst.BlocksToSeed[inst.Sources[i].Name] = make([]int, 0)
-			inst.BlocksSeeding[inst.Sources[i].Name] = make([]int, 0)
-			inst.LeafBlocks[inst.Sources[i].Name] = make([]cid.Cid, inst.Sources[i].BlockCount())
+	if conf.Chunker != "" {
+		if _, err := chunker.FromString(strings.NewReader(""), conf.Chunker); err != nil {
+			panic(err)
 		}
 	}
 
 	{
-		inst.Bsnetwork = bsnet.NewFromIpfsHost(inst.Host, routinghelpers.Null{})
+		inst.Bsnetwork = &limitedNetwork{bsnet.NewFromIpfsHost(inst.Host, routinghelpers.Null{}), inst.bandwidth}
 
-		// TODO: move to a physical data store
-		inst.Bstore = blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
-		inst.Bstore = blockstore.NewIdStore(inst.Bstore)
+		inst.Datastore, err = openDatastore(conf)
+		if err != nil {
+			panic(err)
+		}
+
+		inst.accountant = newAccountant(context.Background(), blockstore.NewBlockstore(inst.Datastore))
+		inst.Bstore = blockstore.NewIdStore(inst.accountant)
 	}
 
 	return inst
 }
 
-func (inst *Instance) getNodeAndProcess(ctx context.Context, dserv format.DAGService, source Source) {
-
-	fetchAndProcessChan := make(chan error)
-	// retryFetchChan := make(chan bool) // Needs implementation --> retries periodically.
-
-	var TIMEOUT time.Duration = 5
-	if source.Size > 1000000 {
-		TIMEOUT = 10 // Arbitrary num
-	}
-
-	log.Println("Looking at source:", source)
-	cidStr := source.Cid
+func (inst *Instance) Start(ctx context.Context, httpPeers []string) {
+	ctx, inst.cancel = context.WithCancel(ctx)
 
-	// This blocks until we get info
-	// XXX: make this non-blocking, add a timeout or something...
+	// NOTE(Tom): these interfaces do the actual storage, the blocks end up in whichever datastore XNODE_DATASTORE picks (see datastore.go)
+	inst.Bsserver = bsserver.New(ctx, inst.Bsnetwork, inst.Bstore, bsserver.WithTracer(accessTracer{inst.access}))
+	inst.Bsclient = bsclient.New(ctx, inst.Bsnetwork, inst.Bstore, bsclient.WithBlockReceivedNotifier(reputationNotifier{inst.reputation, inst.Bsserver}))
 
-	// --- Resolved
+	inst.Bservice = blockservice.New(inst.Bstore, inst.Bsclient)
 
-	go func(source Source, fetchAndProcessChan chan<- error) {
-		defer close(fetchAndProcessChan)
-		node, err := dserv.Get(ctx, cid.MustParse(cidStr))
+	role := inst.Role()
+	log.Println("Starting as a", role, "node")
 
-		log.Println("got node")
+	// Start sharing and caring!!
+	if inst.exchangesBlocks() {
+		inst.Bsnetwork.Start(inst.Bsclient, inst.Bsserver)
+	}
 
-		if err != nil {
-			log.Println(err)
-			panic("")
+	// Have to run this on a different thread, otherwise this will block instance.Start(...) and never cancel the context
+	inst.goRun(func() {
+		inst.loadSources(ctx)
+		inst.goRun(func() { inst.watchRegistry(ctx) })
+
+		switch role {
+		case ROLE_GATEWAY:
+			// Blocks are fetched when someone asks for them, there's no share to keep, only cache to collect
+			inst.Status = SERVING_GATEWAY
+			inst.goRun(func() { inst.runGC(ctx) })
+			inst.runCacheEviction(ctx)
+			return
+		case ROLE_LIGHT:
+			inst.Status = OBSERVING
+			return
+		case ROLE_SEEDER:
+			inst.runSeedServer(ctx)
 		}
 
-		leaves := inst.LeafBlocks[source.Name]
-		size, _ := node.Size()
-		blockCount := int(blocksInSize(int64(size)))
-
-		log.Println("chunkcount", blockCount)
-
-		// XXX: maybe use a stack instead of recursion...
-		// also use GetMany instead of Get
-		leafCount := 0
-		var getleaves func(c cid.Cid)
-		getleaves = func(c cid.Cid) {
-			node, _ := dserv.Get(ctx, c)
-
-			links := node.Links()
-
-			if len(links) > 0 {
-				cids := make([]cid.Cid, len(links))
-				for i := range links {
-					cids[i] = links[i].Cid
-				}
+		// If everything we need is already on disk we can go straight back to seeding
+		restored := inst.restoreFromDisk(ctx)
+		holdsBlocks := false
+		if restored {
+			inst.BlockMapsMutex.Lock()
+			for _, seeding := range inst.BlocksSeeding {
+				holdsBlocks = holdsBlocks || len(seeding) > 0
+			}
+			inst.BlockMapsMutex.Unlock()
 
-				if cids[0].Type() == cid.Raw {
-					for _, cc := range cids {
-						leaves[leafCount] = cc
-						leafCount++
-					}
-					return
-				} else {
-					for i := range cids {
-						getleaves(cids[i])
-					}
-					return
-				}
-			} else if c.Type() == cid.Raw {
-				// XXX: This might not be threadsafe, just in case you  want to multithread :)
-				leaves[leafCount] = c
-				leafCount++
-			} else {
-				// crappy assertion
-				log.Panicln("This should be impossible")
+			if holdsBlocks {
+				inst.Status = SEEDING_BLOCKS
 			}
 		}
 
-		getleaves(node.Cid())
-		fetchAndProcessChan <- nil
-	}(source, fetchAndProcessChan)
-
-	select {
-	case err := <-fetchAndProcessChan:
-		if err != nil {
-			log.Println("Failed to get node or process leaves:", err)
-		} else {
-			log.Println("Successfully got node and processed leaves for source", source)
-		}
-	case <-time.After(TIMEOUT * time.Second):
-		log.Println("Timeout while fetching & processing source:", source)
-		// retryFetchChan <- true
-	}
-}
-
-func (inst *Instance) Start(ctx context.Context, httpPeers []string) {
-
-	// NOTE(Tom): these interfaces do the actual storage, it's currently configured to do everything in RAM
-	inst.Bsclient = bsclient.New(ctx, inst.Bsnetwork, inst.Bstore)
-	inst.Bsserver = bsserver.New(ctx, inst.Bsnetwork, inst.Bstore)
-
-	inst.Bservice = blockservice.New(inst.Bstore, inst.Bsclient)
-
-	if os.Getenv("XNODE_NAME") == "Xnode-1" {
-		// Have to run this on a different thread, otherwise this will block instance.Start(...) and never cancel the context
-		go func() {
-			inst.runSeedServer(ctx)
-
-			<-ctx.Done()
-		}()
-
-		return
-	}
-
-	// Start sharing and caring!!
-	inst.Bsnetwork.Start(inst.Bsclient, inst.Bsserver)
-
-	go func() {
 		log.Println("Getting peers")
 
 		// TODO: Now we use libp2p method which is more efficient, keeping this for sake of clarity
-		inst.Status = CONNECTING_TO_PEERS
+		if !holdsBlocks {
+			inst.Status = CONNECTING_TO_PEERS
+		}
 		for iterations := 0; iterations < 3; iterations++ { // Get peers
-			time.Sleep(time.Millisecond * 1000)
+			select {
+			case <-time.After(time.Millisecond * 1000):
+			case <-ctx.Done():
+				return
+			}
 
 			// Note(Tom): This is not ideal.
 			// What should happen in a protocol like this is nodes find each other completely randomly.
@@ -440,298 +411,64 @@ func (inst *Instance) Start(ctx context.Context, httpPeers []string) {
 			}
 		}
 
-		{
+		dserv := merkledag.NewReadOnlyDagService(merkledag.NewSession(ctx, merkledag.NewDAGService(inst.Bservice)))
+		if !restored {
 			inst.Status = GETTING_METADATA
-			dserv := merkledag.NewReadOnlyDagService(merkledag.NewSession(ctx, merkledag.NewDAGService(inst.Bservice)))
-
-			for _, source := range inst.Sources {
-				inst.getNodeAndProcess(ctx, dserv, source)
-			}
+			inst.resolveSources(ctx, dserv)
 		}
+		inst.goRun(func() { inst.retryMetadata(ctx, dserv) })
 
-		// Implement replication mechanism here. Can allot blocks based on frequency of access (Saved in the CID struct, see below, EOF)
-
-		randomizeBlocks := func() { // Which blocks should I seed (as a node (as a millionaire))
-			// Amazing distribution algorithm™️
-			inst.Status = ADJUSTING_WANTED_BLOCKS
-			log.Println("Working out which blocks to seed")
-
-			unstoredBytesAcrossAllSources := int64(0)
-			for _, s := range inst.Sources {
-				unstoredBytesAcrossAllSources += s.Size
-			}
-
-			totalBlockCount := int64(0)
-			for _, s := range inst.Sources {
-				totalBlockCount += s.BlockCount()
-			}
-
-			freeStorage := int64(inst.StorageSize)
-
-			log.Println("Size of all sources", unstoredBytesAcrossAllSources)
-			log.Println("Free storage avalaible", unstoredBytesAcrossAllSources)
-
-			totalIterations := 0
-
-			newBlocksToSeed := make(map[string][]int, len(inst.Sources))
-
-			// TODO: Add a bias to keep blocks it has over blocks it doesn't have
-			for totalIterations < 10000 && unstoredBytesAcrossAllSources > 0 && freeStorage > 0 {
-				totalIterations++
-
-				blockIndex := mrand.Intn(int(totalBlockCount))
-
-				// find source that stores index
-				var source Source
-				for _, s := range inst.Sources {
-					if blockIndex-int(s.BlockCount()) < 0 {
-						// this should work?
-						source = s
-						break
-					} else {
-						blockIndex -= int(s.BlockCount())
-					}
-				}
-
-				blocksInSource := int(source.BlockCount())
-
-				blocksForSource := newBlocksToSeed[source.Name]
-
-				if blocksInSource <= len(blocksForSource) {
-					// log.Println("Failed here", totalIterations)
-					// reroll
-					continue
-				} else {
-					// make sure block index isn't already stored
-
-					// XXX: This is a naive implementation, this should be optimized to not take into account blocks we already store
-
-					// try to find a block that we don't have
-					potentialBlockIndex := mrand.Intn(blocksInSource)
-					uniqueBlockIndex := true
-
-					// is this index in the thing?
-					for _, i := range blocksForSource {
-						if i == potentialBlockIndex {
-							uniqueBlockIndex = false
-						}
-					}
-
-					if uniqueBlockIndex {
-						size := 0
-						if potentialBlockIndex == blocksInSource-1 {
-							// the size is the remainder since the last block is only as big as the leftover data
-							size = int(source.Size) - ((blocksInSource - 1) * int(DEFAULT_BLOCK_SIZE))
-						} else {
-							// the size is just the chunk size!!
-							size = int(DEFAULT_BLOCK_SIZE)
-						}
-
-						if freeStorage-int64(size) <= 0 {
-							// sadly this is too big
-							// log.Println("Not enough storage")
-							continue
-						} else {
-							// Don't do this until we know we have enough space
-							// add to registered list of blocks tracked
-							newBlocksToSeed[source.Name] = append(newBlocksToSeed[source.Name], potentialBlockIndex)
-							// log.Println("blocks increased")
-
-							// decrease max storage
-							// decrease space available
-							freeStorage -= int64(size)
-							unstoredBytesAcrossAllSources -= int64(size)
-							// fmt.Println("free storage", freeStorage)
-							// fmt.Println("unallocated storage", unstoredBytesAcrossAllSources)
-						}
-					} else {
-						// log.Println("Block index not unique")
-						continue
-					}
-				}
-			}
-
-			// copy new blocks to seed to existing map
-			log.Println("Waiting for block mutex")
-			inst.BlockMapsMutex.Lock()
-			inst.BlocksToSeed = newBlocksToSeed
-			inst.BlockMapsMutex.Unlock()
+		// Keep watching the cluster so we know how many copies of each leaf are out there
+		inst.goRun(func() { inst.replicateData(ctx) })
+		if inst.Members != nil {
+			events := inst.Members.Subscribe()
+			inst.goRun(func() { inst.watchMembership(ctx, events) })
 		}
+		inst.goRun(func() { inst.runGC(ctx) })
+		inst.goRun(func() { inst.runScrub(ctx) })
+		inst.goRun(func() { inst.runChallenges(ctx) })
 
-		randomizeBlocks()
-		prevSize := inst.StorageSize
-
-		for {
-			t := time.NewTicker(500 * time.Millisecond)
-
-			select {
-			case <-t.C:
-
-				{ // block adjustment
-					if prevSize != inst.StorageSize {
-						randomizeBlocks()
-					}
-
-					prevSize = inst.StorageSize
-				}
-
-				{ // download data to be seeded
-
-					// TODO: check if BlocksToSeed and BlocksSeeding are different before running all this code
-					inst.Status = DOWNLOADING_BLOCKS
-
-					// NOTE(Tom): This might be inefficient. Haven't tested though
-					dserv := merkledag.NewReadOnlyDagService(merkledag.NewSession(ctx, merkledag.NewDAGService(inst.Bservice)))
-
-					// get the leaves' metadata!!
-					for _, source := range inst.Sources {
-						inst.BlockMapsMutex.Lock()
-
-						// clear previous array of seeded blocks
-						inst.BlocksSeeding[source.Name] = make([]int, 0)
-						seedingBlocks := inst.BlocksToSeed[source.Name]
-
-						fmt.Println("Blocks for this source:", len(seedingBlocks), seedingBlocks)
-
-						leaves := inst.LeafBlocks[source.Name]
-
-						var wg sync.WaitGroup
-						var mu sync.Mutex
-
-						for i := 0; i < int(source.BlockCount()); i++ {
-							isInSeedList := false
-
-							for _, j := range seedingBlocks {
-								if i == j && i < len(leaves) {
-									if leaves[i].Defined() {
-										wg.Add(1)
-										go func(index int) {
-											ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
-											defer cancel()
-
-											_, err := dserv.Get(ctx, leaves[index])
-											if err == nil {
-												mu.Lock()
-												defer mu.Unlock()
-												inst.BlocksSeeding[source.Name] = append(inst.BlocksSeeding[source.Name], index)
-											}
-											wg.Done()
-										}(i)
-
-										isInSeedList = true
-									} else {
-										log.Println("Fail!", i, leaves[i])
-									}
-								}
-							}
-
-							if !isInSeedList {
-								inst.Bservice.DeleteBlock(ctx, leaves[i])
-							}
-						}
-
-						wg.Wait()
-						inst.BlockMapsMutex.Unlock()
-					}
-
-					inst.Status = SEEDING_BLOCKS
-				}
-
-				continue
-			case <-ctx.Done():
-				return
-			}
+		// A restored node keeps the blocks it had rather than rolling new ones
+		if !holdsBlocks {
+			inst.allocateBlocks()
 		}
-	}()
-}
-
-func (inst *Instance) Stop() {
-	// TODO: consider implementing this...
-}
-
-const (
-	replicationThreshold = 2
-	heartbeatInterval    = 5 * time.Second
-)
-
-type CidStruct struct {
-	CidString         string
-	CidMetaData       cid.Cid
-	ReplicationFactor int
-	CallFrequency     int
+		inst.runSync(ctx, dserv)
+	})
 }
 
-type ConnNodeMap struct {
-	NodeId  string
-	CidList []CidStruct
+// Runs f in a goroutine Stop waits for
+func (inst *Instance) goRun(f func()) {
+	inst.running.Add(1)
+	go func() {
+		defer inst.running.Done()
+		f()
+	}()
 }
 
-// Yet to finish this. But the strategy is to maintain a replication factory 'n' for each Cid such that in an event of nodes going offline or
-// if nodes volunteeringly stop seeding, the data is replicated to other nodes such that its not lost.
-
-// Design : https://excalidraw.com/#json=wehehgwv9tjnyYR4Ts8jD,2gnZ8ScVhNlQomFieUGfAQ
-
-func (inst *Instance) replicateData(ctx context.Context) {
-
-	// these will be part of the instance. But for testing they are separate
-	// connectedNodes := make([]ConnNodeMap, 0)
-	// currentPermanentConnections := make([]ConnNodeMap, 0)
-	// replicateDataChan := make(chan struct{})
-
-	// Listening for replicateData requests from any peer
-	// for {
-	// 	select {
-	// 	case req := <-replicateDataChan:
-	// 		cids := inst.sendReplicationRequest()
-	// 		connNodeMap := ConnNodeMap{
-	// 			NodeId:  req.NodeId,
-	// 			CidList: cids,
-	// 		}
-	// 		connectedNodes = append(connectedNodes, connNodeMap)
-
-	// 	case offlineNode := <-offlineNodeChan:
-	// 		// Handle nodes going offline
-	// 		for i, node := range connectedNodes {
-	// 			if node.NodeId == offlineNode.NodeId {
-	// 				connectedNodes = append(connectedNodes[:i], connectedNodes[i+1:]...)
-	// 				break
-	// 			}
-	// 		}
-
-	// 		// Inform other nodes about the reduced replication factor before dying
-	// 		inst.informNodesModifiedReplicationFactor(connectedNodes)
-
-	// 	case <-ctx.Done():
-	// 		return
-	// 	}
-
-	// 	// Periodically send Cid and their corresponding repli factor to other nodes
-	// 	select {
-	// 	case <-time.After(dataSendInterval):
-	// 		for _, node := range currentPermanentConnections {
-	// 			inst.sendHeartbeatWithData(node)
-	// 		}
-	// 	default:
-	// 	}
-
-	// 	// Respond to requests with CidList
-	// 	select {
-	// 	case req := <-cidListRequestChan:
-	// 		for _, node := range currentPermanentConnections {
-	// 			if node.NodeId == req.NodeId {
-	// 				resp := CidListResponse{
-	// 					NodeId:  inst.Host.ID().String(),
-	// 					CidList: node.CidList,
-	// 				}
-	// 				req.ResponseChan <- resp
-	// 				break
-	// 			}
-	// 		}
-	// 	default:
-	// 	}
-	// }
-}
+// Stop cancels everything Start started and waits for it, then shuts down bitswap, the host and the datastore.
+// Call Drain first to hand off our blocks.
+func (inst *Instance) Stop() {
+	// Nothing can be using the blockstore once it's closed
+	if inst.cancel != nil {
+		inst.cancel()
+	}
+	inst.running.Wait()
 
-func (inst *Instance) sendReplicationRequest(CidStruct) {
+	if inst.Bsclient != nil {
+		inst.Bsclient.Close()
+	}
+	if inst.Bsserver != nil {
+		inst.Bsserver.Close()
+	}
+	if inst.exchangesBlocks() && inst.Bsclient != nil {
+		inst.Bsnetwork.Stop()
+	}
+	if err := inst.Host.Close(); err != nil {
+		log.Println("Failed to close host:", err)
+	}
 
+	// Flush everything to disk so we can pick up where we left off
+	if err := inst.Datastore.Close(); err != nil {
+		log.Println("Failed to close datastore:", err)
+	}
 }
@@ -0,0 +1,48 @@
+package ipfs_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+func TestStop(t *testing.T) {
+	t.Setenv("XNODE_IP", "127.0.0.1")
+	conf := ipfs.DefaultConfig()
+	conf.Datastore = ipfs.DATASTORE_MEMORY
+	inst := ipfs.NewInstance(conf)
+	inst.Start(context.Background(), nil)
+
+	// Everything Start kicked off is gone by the time Stop returns, without waiting on the peer search
+	started := time.Now()
+	inst.Stop()
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestSeedServer_SkipsBadFiles(t *testing.T) {
+	t.Setenv("XNODE_IP", "127.0.0.1")
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "good.csv"), []byte("a,b\n1,2\n"), 0o644))
+	// Listed but can't be opened
+	assert.Nil(t, os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "broken.csv")))
+
+	conf := ipfs.DefaultConfig()
+	conf.Datastore = ipfs.DATASTORE_MEMORY
+	conf.Role = ipfs.ROLE_SEEDER
+	conf.SourcesDir = dir
+	inst := ipfs.NewInstance(conf)
+	inst.Start(context.Background(), nil)
+	defer inst.Stop()
+
+	assert.Eventually(t, func() bool {
+		_, err := inst.SourceByName("good.csv")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err := inst.SourceByName("broken.csv")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,142 @@
+package ipfs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+const defaultFailureGrace = 30 * time.Second
+
+// MembershipEvents tells us when nodes join, leave or fail, gossip provides this
+type MembershipEvents interface {
+	Subscribe() <-chan model.MemberEvent
+}
+
+// A node that failed, we keep counting its copies until the grace period is up in case it comes back
+type departure struct {
+	state  model.NodeState
+	failed time.Time
+}
+
+// departures are the failed nodes still in their grace period, by gossip name
+type departures struct {
+	mutex sync.Mutex
+	nodes map[string]departure
+}
+
+func (d *departures) add(name string, state model.NodeState) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.nodes == nil {
+		d.nodes = make(map[string]departure)
+	}
+	d.nodes[name] = departure{state: state, failed: time.Now()}
+}
+
+// Returns true if the node was in its grace period
+func (d *departures) remove(name string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	_, ok := d.nodes[name]
+	delete(d.nodes, name)
+	return ok
+}
+
+// Drops the nodes that failed longer than grace ago, returns their names
+func (d *departures) expire(grace time.Duration) []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	expired := make([]string, 0)
+	for name, dep := range d.nodes {
+		if time.Since(dep.failed) >= grace {
+			expired = append(expired, name)
+			delete(d.nodes, name)
+		}
+	}
+	return expired
+}
+
+func (d *departures) states() []model.NodeState {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	states := make([]model.NodeState, 0, len(d.nodes))
+	for _, dep := range d.nodes {
+		states = append(states, dep.state)
+	}
+	return states
+}
+
+func (inst *Instance) failureGrace() time.Duration {
+	if inst.Config.FailureGrace > 0 {
+		return inst.Config.FailureGrace
+	}
+	return defaultFailureGrace
+}
+
+// The cluster view with the failed nodes that are still in their grace period.
+// Only for counting copies, nobody is going to answer a challenge or a fetch from them.
+func (inst *Instance) clusterStates() []model.NodeState {
+	if inst.Cluster == nil {
+		return nil
+	}
+
+	states := inst.Cluster.ClusterState()
+	present := make(map[string]bool, len(states))
+	for _, s := range states {
+		present[s.PeerID] = true
+	}
+	for _, s := range inst.departed.states() {
+		if s.PeerID != "" && !present[s.PeerID] {
+			states = append(states, s)
+		}
+	}
+	return states
+}
+
+// Follows the members joining and leaving.
+// A node that left drained first so its leaves are reallocated straight away.
+// A node that failed might just be restarting, its copies keep counting until the grace period is up,
+// then the leaves it held are under replicated and the surviving nodes claim them.
+func (inst *Instance) watchMembership(ctx context.Context, events <-chan model.MemberEvent) {
+	grace := inst.failureGrace()
+	t := time.NewTicker(max(grace/4, time.Millisecond))
+	defer t.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			switch e.Type {
+			case model.MEMBER_FAILED:
+				log.Println("Node", e.Name, "failed, re-replicating its blocks in", grace, "unless it comes back")
+				inst.departed.add(e.Name, e.State)
+			case model.MEMBER_LEFT:
+				log.Println("Node", e.Name, "left")
+				inst.departed.remove(e.Name)
+				inst.reallocate()
+			case model.MEMBER_JOINED:
+				if inst.departed.remove(e.Name) {
+					log.Println("Node", e.Name, "came back")
+				}
+				inst.reallocate()
+			}
+		case <-t.C:
+			expired := inst.departed.expire(grace)
+			for _, name := range expired {
+				log.Println("Node", name, "didn't come back, re-replicating its blocks")
+			}
+			if len(expired) > 0 {
+				inst.reallocate()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+const (
+	metadataBatchSize     = 64
+	metadataRetries       = 5
+	metadataBatchTimeout  = 10 * time.Second
+	metadataBackoff       = 500 * time.Millisecond
+	metadataMaxBackoff    = 10 * time.Second
+	metadataRetryInterval = 30 * time.Second
+)
+
+// MetadataProgress is how far along we are resolving the leaves of a source
+type MetadataProgress struct {
+	Resolved    bool // Every leaf is known, the source can be allocated
+	Fetching    bool
+	Attempts    int // Times the whole walk was started
+	NodesWalked int
+	LeavesFound int
+	LastError   string
+}
+
+// metadataTracker keeps the progress of every source, by name
+type metadataTracker struct {
+	mutex    sync.Mutex
+	progress map[string]*MetadataProgress
+}
+
+func (t *metadataTracker) update(name string, f func(p *MetadataProgress)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.progress == nil {
+		t.progress = make(map[string]*MetadataProgress)
+	}
+	p, ok := t.progress[name]
+	if !ok {
+		p = &MetadataProgress{}
+		t.progress[name] = p
+	}
+	f(p)
+}
+
+// Marks a source as being fetched, returns false if someone else is already at it
+func (t *metadataTracker) begin(name string) bool {
+	started := false
+	t.update(name, func(p *MetadataProgress) {
+		if p.Fetching || p.Resolved {
+			return
+		}
+		p.Fetching = true
+		p.Attempts++
+		p.NodesWalked = 0
+		p.LeavesFound = 0
+		started = true
+	})
+	return started
+}
+
+func (t *metadataTracker) resolved(name string, leaves int) {
+	t.update(name, func(p *MetadataProgress) {
+		p.Fetching = false
+		p.Resolved = true
+		p.LeavesFound = leaves
+		p.LastError = ""
+	})
+}
+
+func (t *metadataTracker) failed(name string, err error) {
+	t.update(name, func(p *MetadataProgress) {
+		p.Fetching = false
+		p.Resolved = false
+		p.LastError = err.Error()
+	})
+}
+
+func (t *metadataTracker) isResolved(name string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	p, ok := t.progress[name]
+	return ok && p.Resolved
+}
+
+func (t *metadataTracker) remove(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.progress, name)
+}
+
+// MetadataProgress returns a snapshot of the metadata progress of every known source
+func (inst *Instance) MetadataProgress() map[string]MetadataProgress {
+	inst.metadata.mutex.Lock()
+	defer inst.metadata.mutex.Unlock()
+
+	snapshot := make(map[string]MetadataProgress, len(inst.metadata.progress))
+	for name, p := range inst.metadata.progress {
+		snapshot[name] = *p
+	}
+	return snapshot
+}
+
+// Gets every node in cids into nodes, retrying the missing ones with a backoff
+func getBatch(ctx context.Context, ng format.NodeGetter, cids []cid.Cid, nodes map[cid.Cid]format.Node, retries int, onRetry func(err error)) error {
+	missing := cids
+	backoff := metadataBackoff
+
+	for attempt := 0; ; attempt++ {
+		var lastErr error
+
+		bctx, cancel := context.WithTimeout(ctx, metadataBatchTimeout)
+		for opt := range ng.GetMany(bctx, missing) {
+			if opt.Err != nil {
+				lastErr = opt.Err
+				continue
+			}
+			nodes[opt.Node.Cid()] = opt.Node
+		}
+		cancel()
+
+		stillMissing := make([]cid.Cid, 0)
+		for _, c := range missing {
+			if _, ok := nodes[c]; !ok {
+				stillMissing = append(stillMissing, c)
+			}
+		}
+		missing = stillMissing
+		if len(missing) == 0 {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("couldn't get %d nodes, first one is %s", len(missing), missing[0])
+		}
+		if attempt >= retries {
+			return lastErr
+		}
+
+		if onRetry != nil {
+			onRetry(lastErr)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > metadataMaxBackoff {
+			backoff = metadataMaxBackoff
+		}
+	}
+}
+
+// dagLayout is the shape of a source's DAG
+type dagLayout struct {
+	DataLeaves int // The leaves holding the source's data, any after that are parity
+	Leaves     []cid.Cid
+	LeafSizes  []int64   // Taken from the parent's links, -1 for a root leaf until walkSource fills in the source size
+	Nodes      []cid.Cid // Every intermediate node, the root included
+}
+
+// Walks the DAG under root one level at a time and returns the leaves in order.
+// Every level is fetched in batches through GetMany, a batch is retried up to retries times before giving up.
+// progress is called after each batch with the nodes walked and the leaves found so far.
+func walkLeaves(ctx context.Context, ng format.NodeGetter, root cid.Cid, retries int, progress func(walked, leaves int, err error)) (dagLayout, error) {
+	type entry struct {
+		c    cid.Cid
+		size int64
+		leaf bool
+	}
+
+	level := []entry{{c: root, size: -1, leaf: root.Type() == cid.Raw}}
+	walked := 0
+	layout := dagLayout{Nodes: make([]cid.Cid, 0)}
+
+	for {
+		leaves := 0
+		pending := make([]cid.Cid, 0)
+		seen := make(map[cid.Cid]bool)
+		for _, e := range level {
+			if e.leaf {
+				leaves++
+			} else if !seen[e.c] {
+				seen[e.c] = true
+				pending = append(pending, e.c)
+			}
+		}
+
+		if len(pending) == 0 {
+			layout.DataLeaves = len(level)
+			layout.Leaves = make([]cid.Cid, len(level))
+			layout.LeafSizes = make([]int64, len(level))
+			for i, e := range level {
+				layout.Leaves[i] = e.c
+				layout.LeafSizes[i] = e.size
+			}
+			return layout, nil
+		}
+
+		nodes := make(map[cid.Cid]format.Node, len(pending))
+		for start := 0; start < len(pending); start += metadataBatchSize {
+			end := start + metadataBatchSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+
+			err := getBatch(ctx, ng, pending[start:end], nodes, retries, func(err error) {
+				if progress != nil {
+					progress(walked, leaves, err)
+				}
+			})
+			if err != nil {
+				return dagLayout{}, err
+			}
+
+			walked += end - start
+			if progress != nil {
+				progress(walked, leaves, nil)
+			}
+		}
+
+		next := make([]entry, 0, len(level))
+		for _, e := range level {
+			if e.leaf {
+				next = append(next, e)
+				continue
+			}
+
+			links := nodes[e.c].Links()
+			if len(links) == 0 {
+				// A node without children holds the data itself
+				next = append(next, entry{c: e.c, size: e.size, leaf: true})
+				continue
+			}
+
+			layout.Nodes = append(layout.Nodes, e.c)
+			for _, l := range links {
+				next = append(next, entry{c: l.Cid, size: int64(l.Size), leaf: l.Cid.Type() == cid.Raw})
+			}
+		}
+		level = next
+	}
+}
+
+// Records the layout of a source, BlockMapsMutex has to be held
+func (inst *Instance) setLayout(name string, layout dagLayout) {
+	inst.LeafBlocks[name] = layout.Leaves
+	inst.layouts[name] = layout
+}
+
+// Resolves the leaves of a source and records how it went.
+// A source that can't be resolved keeps no leaves, so it's left out of the allocation until it is.
+func (inst *Instance) fetchMetadata(ctx context.Context, ng format.NodeGetter, source Source) error {
+	if !inst.metadata.begin(source.Name) {
+		return nil
+	}
+
+	log.Println("Fetching metadata for source", source.Name)
+	layout, err := walkSource(ctx, ng, source, metadataRetries, func(walked, found int, err error) {
+		inst.metadata.update(source.Name, func(p *MetadataProgress) {
+			p.NodesWalked = walked
+			p.LeavesFound = found
+			if err != nil {
+				p.LastError = err.Error()
+			}
+		})
+	})
+	if err != nil {
+		log.Println("Couldn't resolve the metadata of source", source.Name, ":", err)
+		inst.metadata.failed(source.Name, err)
+		return err
+	}
+
+	if _, err := inst.SourceByName(source.Name); err != nil {
+		// Removed while we were walking it
+		inst.metadata.remove(source.Name)
+		return err
+	}
+
+	leaves := len(layout.Leaves)
+	if !sameLeafSizes(source, layout) {
+		// The DAG is what we go by
+		log.Println("Source", source.Name, "has", layout.DataLeaves, "leaves but its leaf table says", source.BlockCount())
+	}
+
+	inst.BlockMapsMutex.Lock()
+	inst.setLayout(source.Name, layout)
+	inst.BlockMapsMutex.Unlock()
+
+	inst.metadata.resolved(source.Name, leaves)
+	log.Println("Resolved", leaves, "leaves for source", source.Name)
+	return nil
+}
+
+// Resolves every source that isn't resolved yet, in parallel, and waits for them
+func (inst *Instance) resolveSources(ctx context.Context, ng format.NodeGetter) {
+	var wg sync.WaitGroup
+	for _, source := range inst.SourceList() {
+		if inst.metadata.isResolved(source.Name) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(source Source) {
+			defer wg.Done()
+			inst.fetchMetadata(ctx, ng, source)
+		}(source)
+	}
+	wg.Wait()
+}
+
+// Every so often tries the sources that couldn't be resolved again
+func (inst *Instance) retryMetadata(ctx context.Context, ng format.NodeGetter) {
+	t := time.NewTicker(metadataRetryInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			unresolved := false
+			for _, source := range inst.SourceList() {
+				unresolved = unresolved || !inst.metadata.isResolved(source.Name)
+			}
+			if unresolved {
+				inst.resolveSources(ctx, ng)
+				inst.reallocate()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Checks the data leaves of a layout against the leaf size table of the source, sources without one always match
+func sameLeafSizes(source Source, layout dagLayout) bool {
+	if len(source.LeafSizes) == 0 {
+		return true
+	}
+	if len(source.LeafSizes) != layout.DataLeaves {
+		return false
+	}
+	for i, size := range source.LeafSizes {
+		if layout.LeafSizes[i] != size {
+			return false
+		}
+	}
+	return true
+}
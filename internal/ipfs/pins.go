@@ -0,0 +1,159 @@
+package ipfs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+// PinSet is what keeps the blocks of a source from being garbage collected
+type PinSet struct {
+	Recursive []cid.Cid // Roots whose metadata is kept, the leaves under them aren't unless they're pinned directly
+	Direct    []cid.Cid // Leaves kept on their own, the ones allocated to this node
+}
+
+// pinner holds the pin set of every source, by name, and the blocks of ingests that aren't sources yet
+type pinner struct {
+	mutex     sync.Mutex
+	sets      map[string]PinSet
+	staged    map[int][]cid.Cid // by ingest
+	nextStage int
+}
+
+func newPinner() *pinner {
+	return &pinner{sets: make(map[string]PinSet), staged: make(map[int][]cid.Cid)}
+}
+
+// Starts a set of blocks that are kept until the ingest writing them is done
+func (p *pinner) newStage() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.nextStage++
+	p.staged[p.nextStage] = make([]cid.Cid, 0)
+	return p.nextStage
+}
+
+func (p *pinner) stage(id int, cids ...cid.Cid) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if set, ok := p.staged[id]; ok {
+		p.staged[id] = append(set, cids...)
+	}
+}
+
+func (p *pinner) unstage(id int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.staged, id)
+}
+
+// Every block of the ingests that are still going
+func (p *pinner) stagedSnapshot() []cid.Cid {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	cids := make([]cid.Cid, 0)
+	for _, set := range p.staged {
+		cids = append(cids, set...)
+	}
+	return cids
+}
+
+// pinningDAG pins every node before it's written, so the GC keeps an ingest's blocks before there's a source to pin them
+type pinningDAG struct {
+	format.DAGService
+	pins  *pinner
+	stage int
+}
+
+func (d *pinningDAG) Add(ctx context.Context, nd format.Node) error {
+	d.pins.stage(d.stage, nd.Cid())
+	return d.DAGService.Add(ctx, nd)
+}
+
+func (d *pinningDAG) AddMany(ctx context.Context, nds []format.Node) error {
+	cids := make([]cid.Cid, len(nds))
+	for i, nd := range nds {
+		cids[i] = nd.Cid()
+	}
+	d.pins.stage(d.stage, cids...)
+	return d.DAGService.AddMany(ctx, nds)
+}
+
+func (p *pinner) pinRecursive(name string, roots ...cid.Cid) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	set := p.sets[name]
+	set.Recursive = append([]cid.Cid(nil), roots...)
+	p.sets[name] = set
+}
+
+// Replaces the leaves pinned directly for a source
+func (p *pinner) pinDirect(name string, leaves []cid.Cid) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	set := p.sets[name]
+	set.Direct = leaves
+	p.sets[name] = set
+}
+
+func (p *pinner) unpin(name string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.sets, name)
+}
+
+func (p *pinner) snapshot() map[string]PinSet {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sets := make(map[string]PinSet, len(p.sets))
+	for k, v := range p.sets {
+		sets[k] = v
+	}
+	return sets
+}
+
+// The roots of a source, the parity root too if it's erasure coded
+func sourceRoots(source Source) []cid.Cid {
+	roots := make([]cid.Cid, 0, 2)
+	if c, err := cid.Parse(source.Cid); err == nil {
+		roots = append(roots, c)
+	}
+	if source.Erasure != nil {
+		if c, err := cid.Parse(source.Erasure.Cid); err == nil {
+			roots = append(roots, c)
+		}
+	}
+	return roots
+}
+
+// Pins the leaves every source wants directly, has to be called with BlockMapsMutex held
+func (inst *Instance) pinAllocatedLocked() {
+	for name, leaves := range inst.LeafBlocks {
+		pinned := make([]cid.Cid, 0, len(inst.BlocksToSeed[name]))
+		for _, i := range inst.BlocksToSeed[name] {
+			if i < len(leaves) && leaves[i].Defined() {
+				pinned = append(pinned, leaves[i])
+			}
+		}
+		inst.pins.pinDirect(name, pinned)
+	}
+}
+
+// Pins returns the pin set of every source, by name
+func (inst *Instance) Pins() map[string]PinSet {
+	inst.BlockMapsMutex.Lock()
+	inst.pinAllocatedLocked()
+	inst.BlockMapsMutex.Unlock()
+
+	return inst.pins.snapshot()
+}
@@ -0,0 +1,301 @@
+package ipfs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/boxo/bitswap/message"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	accessWindow        = 10 * time.Minute
+	accessBuckets       = 10
+	defaultHotThreshold = 10
+	// Most hot leaves a node shares through gossip
+	hotShared = 32
+)
+
+// AccessTracker counts the requests for every block over a sliding window.
+// The window is split into buckets and the oldest one falls off as time moves on.
+type AccessTracker struct {
+	Clock   func() time.Time // time.Now if nil
+	mutex   sync.Mutex
+	bucket  time.Duration
+	counts  []map[string]int  // the newest bucket first
+	served  []map[string]bool // peer and cid of every block sent within each bucket
+	started time.Time         // when the newest bucket started
+}
+
+func NewAccessTracker(window time.Duration, buckets int) *AccessTracker {
+	t := &AccessTracker{
+		bucket:  window / time.Duration(buckets),
+		counts:  make([]map[string]int, buckets),
+		served:  make([]map[string]bool, buckets),
+		started: time.Now(),
+	}
+	for i := range t.counts {
+		t.counts[i] = make(map[string]int)
+		t.served[i] = make(map[string]bool)
+	}
+	return t
+}
+
+func (t *AccessTracker) now() time.Time {
+	if t.Clock != nil {
+		return t.Clock()
+	}
+	return time.Now()
+}
+
+// Drops the buckets that went out of the window, has to be called with the mutex held
+func (t *AccessTracker) rotate() {
+	now := t.now()
+	if now.Before(t.started) {
+		t.started = now
+	}
+	for i := 0; now.Sub(t.started) >= t.bucket; i++ {
+		if i == len(t.counts) {
+			// Everything's out of the window, no point going through every bucket we missed
+			t.started = now
+			break
+		}
+
+		copy(t.counts[1:], t.counts[:len(t.counts)-1])
+		copy(t.served[1:], t.served[:len(t.served)-1])
+		t.counts[0] = make(map[string]int)
+		t.served[0] = make(map[string]bool)
+		t.started = t.started.Add(t.bucket)
+	}
+}
+
+// Record counts a request for c
+func (t *AccessTracker) Record(c cid.Cid) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rotate()
+	t.counts[0][c.String()]++
+}
+
+// RecordServed counts c being sent to p, once per peer per bucket so a peer asking again doesn't make it any hotter
+func (t *AccessTracker) RecordServed(p peer.ID, c cid.Cid) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rotate()
+	key := p.String() + "/" + c.String()
+	if t.served[0][key] {
+		return
+	}
+	t.served[0][key] = true
+	t.counts[0][c.String()]++
+}
+
+// Count is how many times the block was requested within the window
+func (t *AccessTracker) Count(c string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rotate()
+	total := 0
+	for _, bucket := range t.counts {
+		total += bucket[c]
+	}
+	return total
+}
+
+// Counts returns the requests within the window of every block that had any
+func (t *AccessTracker) Counts() map[string]int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rotate()
+	totals := make(map[string]int)
+	for _, bucket := range t.counts {
+		for c, n := range bucket {
+			totals[c] += n
+		}
+	}
+	return totals
+}
+
+// accessTracer counts the blocks we actually send to peers through bitswap.
+// Wants don't count, peers rebroadcast them and ask around for blocks they end up getting elsewhere.
+type accessTracer struct {
+	access *AccessTracker
+}
+
+func (a accessTracer) MessageReceived(peer.ID, bsmsg.BitSwapMessage) {
+}
+
+func (a accessTracer) MessageSent(p peer.ID, msg bsmsg.BitSwapMessage) {
+	for _, blk := range msg.Blocks() {
+		a.access.RecordServed(p, blk.Cid())
+	}
+}
+
+// accessGetter counts the blocks the retrieval API reads
+type accessGetter struct {
+	format.NodeGetter
+	access *AccessTracker
+}
+
+func (g *accessGetter) Get(ctx context.Context, c cid.Cid) (format.Node, error) {
+	nd, err := g.NodeGetter.Get(ctx, c)
+	if err == nil {
+		g.access.Record(c)
+	}
+	return nd, err
+}
+
+func (g *accessGetter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *format.NodeOption {
+	out := make(chan *format.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for opt := range g.NodeGetter.GetMany(ctx, cids) {
+			if opt.Err == nil {
+				g.access.Record(opt.Node.Cid())
+			}
+			select {
+			case out <- opt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Every leaf we know about, by cid
+func (inst *Instance) leafIndex() map[string]CidStruct {
+	inst.BlockMapsMutex.Lock()
+	defer inst.BlockMapsMutex.Unlock()
+
+	leaves := make(map[string]CidStruct)
+	for _, list := range inst.LeafBlocks {
+		for _, c := range list {
+			if c.Defined() {
+				leaves[c.String()] = CidStruct{CidString: c.String(), CidMetaData: c}
+			}
+		}
+	}
+	return leaves
+}
+
+func (inst *Instance) hotThreshold() int {
+	if inst.Config.HotThreshold > 0 {
+		return inst.Config.HotThreshold
+	}
+	return defaultHotThreshold
+}
+
+// The leaves that were requested within the window, the most requested first
+func (inst *Instance) accessedLeaves() []CidStruct {
+	leaves := inst.leafIndex()
+	accessed := make([]CidStruct, 0)
+	for c, n := range inst.access.Counts() {
+		if leaf, ok := leaves[c]; ok {
+			leaf.CallFrequency = n
+			accessed = append(accessed, leaf)
+		}
+	}
+
+	sort.Slice(accessed, func(i, j int) bool {
+		if accessed[i].CallFrequency != accessed[j].CallFrequency {
+			return accessed[i].CallFrequency > accessed[j].CallFrequency
+		}
+		return accessed[i].CidString < accessed[j].CidString
+	})
+	return accessed
+}
+
+// The leaves requested at least the hot threshold within the window, the most requested first
+func (inst *Instance) localHot() []CidStruct {
+	accessed := inst.accessedLeaves()
+	threshold := inst.hotThreshold()
+
+	for i, leaf := range accessed {
+		if leaf.CallFrequency < threshold {
+			return accessed[:i]
+		}
+	}
+	return accessed
+}
+
+// The hot leaves we share with the cluster, sorted by cid so the state only changes when the set does
+func (inst *Instance) sharedHot() []string {
+	hot := inst.localHot()
+	if len(hot) > hotShared {
+		hot = hot[:hotShared]
+	}
+
+	cids := make([]string, len(hot))
+	for i, h := range hot {
+		cids[i] = h.CidString
+	}
+	sort.Strings(cids)
+	return cids
+}
+
+// How hot every leaf is across the cluster.
+// Our own requests count as they are, every peer that says a leaf is hot adds a threshold's worth.
+func (inst *Instance) clusterHot() map[string]int {
+	hot := make(map[string]int)
+	for _, h := range inst.localHot() {
+		hot[h.CidString] = h.CallFrequency
+	}
+	if inst.Cluster == nil {
+		return hot
+	}
+
+	self := inst.Host.ID().String()
+	threshold := inst.hotThreshold()
+	for _, state := range inst.Cluster.ClusterState() {
+		if state.PeerID == self {
+			continue
+		}
+		for _, c := range state.Hot {
+			hot[c] += threshold
+		}
+	}
+	return hot
+}
+
+// HotBlocks returns up to n of the most requested leaves within the window, with how many copies of each we know about
+func (inst *Instance) HotBlocks(n int) []CidStruct {
+	hot := inst.accessedLeaves()
+	if n > 0 && len(hot) > n {
+		hot = hot[:n]
+	}
+
+	held := inst.heldLeaves()
+	for i := range hot {
+		hot[i].ReplicationFactor = len(inst.replicas.holdersOf(hot[i].CidString))
+		if held[hot[i].CidString] {
+			hot[i].ReplicationFactor++
+		}
+	}
+	return hot
+}
+
+// The leaves this node is seeding, by cid
+func (inst *Instance) heldLeaves() map[string]bool {
+	inst.BlockMapsMutex.Lock()
+	defer inst.BlockMapsMutex.Unlock()
+
+	held := make(map[string]bool)
+	for name, seeding := range inst.BlocksSeeding {
+		leaves := inst.LeafBlocks[name]
+		for _, i := range seeding {
+			if i < len(leaves) && leaves[i].Defined() {
+				held[leaves[i].String()] = true
+			}
+		}
+	}
+	return held
+}
@@ -0,0 +1,83 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+func TestAccessTracker_Window(t *testing.T) {
+	now := time.Now()
+	tracker := ipfs.NewAccessTracker(400*time.Millisecond, 2)
+	tracker.Clock = func() time.Time { return now }
+	c := cid.MustParse("bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku")
+
+	tracker.Record(c)
+	tracker.Record(c)
+	assert.Equal(t, 2, tracker.Count(c.String()))
+
+	// Still in the window a bucket later
+	now = now.Add(250 * time.Millisecond)
+	tracker.Record(c)
+	assert.Equal(t, 3, tracker.Count(c.String()))
+	assert.Equal(t, map[string]int{c.String(): 3}, tracker.Counts())
+
+	// The first two fall off once their bucket leaves the window
+	now = now.Add(250 * time.Millisecond)
+	assert.Equal(t, 1, tracker.Count(c.String()))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, 0, tracker.Count(c.String()))
+	assert.Empty(t, tracker.Counts())
+}
+
+func TestAccessTracker_Served(t *testing.T) {
+	now := time.Now()
+	tracker := ipfs.NewAccessTracker(400*time.Millisecond, 2)
+	tracker.Clock = func() time.Time { return now }
+	c := cid.MustParse("bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku")
+
+	// A peer getting the same block again in a bucket only counts once
+	tracker.RecordServed("a", c)
+	tracker.RecordServed("a", c)
+	tracker.RecordServed("b", c)
+	assert.Equal(t, 2, tracker.Count(c.String()))
+
+	now = now.Add(250 * time.Millisecond)
+	tracker.RecordServed("a", c)
+	assert.Equal(t, 3, tracker.Count(c.String()))
+}
+
+func TestHotBlocks(t *testing.T) {
+	ctx := context.Background()
+	inst := offlineInstance(t)
+
+	content := make([]byte, 3*4096)
+	rand.New(rand.NewSource(1)).Read(content)
+	source, err := inst.AddSource(ctx, "data", bytes.NewReader(content))
+	assert.Nil(t, err)
+	assert.Empty(t, inst.HotBlocks(0))
+
+	// Every read through the retrieval API counts
+	for i := 0; i < 3; i++ {
+		r, err := inst.OpenCid(ctx, cid.MustParse(source.Cid))
+		assert.Nil(t, err)
+		io.Copy(io.Discard, r)
+	}
+
+	hot := inst.HotBlocks(10)
+	assert.Len(t, hot, 3)
+	for _, leaf := range hot {
+		assert.Equal(t, 3, leaf.CallFrequency)
+		// Only we hold it
+		assert.Equal(t, 1, leaf.ReplicationFactor)
+	}
+	assert.Len(t, inst.HotBlocks(2), 2)
+}
@@ -0,0 +1,562 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+const (
+	replicationThreshold = 2
+	heartbeatInterval    = 5 * time.Second
+)
+
+type CidStruct struct {
+	CidString         string
+	CidMetaData       cid.Cid
+	ReplicationFactor int
+	CallFrequency     int
+}
+
+// ClusterView is what the rest of the cluster looks like, gossip provides this
+type ClusterView interface {
+	ClusterState() []model.NodeState
+}
+
+// The strategy is to maintain a replication factor 'n' for each Cid such that in an event of nodes going offline or
+// if nodes volunteeringly stop seeding, the data is replicated to other nodes such that its not lost.
+// Every node learns what its peers are holding through gossip and works out which leaves are under replicated.
+// Nobody coordinates this, each node claims leaves that need more copies and lets go of leaves that have too many.
+
+// Design : https://excalidraw.com/#json=wehehgwv9tjnyYR4Ts8jD,2gnZ8ScVhNlQomFieUGfAQ
+
+// replicaSet is what the rest of the cluster is holding, by leaf cid
+type replicaSet struct {
+	mutex   sync.Mutex
+	holders map[string][]string // leaf cid -> node ids holding it
+	members string              // the live members and their capacity, as last seen
+	hot     map[string]int      // how hot every hot leaf is across the cluster, by leaf cid
+	// peers whose copies don't count, their reputation is too low
+	distrusted map[string]bool
+}
+
+func (inst *Instance) replicationFactor() int {
+	if inst.Config.ReplicationFactor > 0 {
+		return inst.Config.ReplicationFactor
+	}
+
+	return replicationThreshold
+}
+
+// LocalState is what this node shares with the cluster through gossip
+func (inst *Instance) LocalState() model.NodeState {
+	sources := inst.SourceList()
+	state := model.NodeState{
+		PeerID:   inst.Host.ID().String(),
+		Role:     inst.Role(),
+		Capacity: inst.capacity(),
+		Holdings: make(map[string]model.Bitmap, len(sources)),
+		Hot:      inst.sharedHot(),
+		Draining: inst.Draining(),
+	}
+
+	inst.BlockMapsMutex.Lock()
+	defer inst.BlockMapsMutex.Unlock()
+
+	for _, source := range sources {
+		bitmap := model.NewBitmap(len(inst.LeafBlocks[source.Name]))
+		for _, i := range inst.BlocksSeeding[source.Name] {
+			bitmap.Set(i)
+		}
+		state.Holdings[source.Cid] = bitmap
+	}
+
+	return state
+}
+
+// The live nodes taking a share of the sources, with the capacity they advertise. This node is always in there.
+func (inst *Instance) liveMembers() []Member {
+	self := inst.Host.ID().String()
+	members := []Member{{PeerID: self, Capacity: int64(inst.StorageSize())}}
+	if inst.Cluster == nil {
+		return members
+	}
+
+	for _, state := range inst.clusterStates() {
+		if state.PeerID == self || state.PeerID == "" || state.Role != ROLE_STORAGE || state.Draining {
+			continue
+		}
+		members = append(members, Member{PeerID: state.PeerID, Capacity: state.Capacity})
+	}
+	return members
+}
+
+// The peer ids of the other nodes in the cluster view
+func (inst *Instance) clusterPeers() []string {
+	peers := make([]string, 0)
+	if inst.Cluster == nil {
+		return peers
+	}
+
+	self := inst.Host.ID().String()
+	for _, state := range inst.Cluster.ClusterState() {
+		if state.PeerID != self && state.PeerID != "" {
+			peers = append(peers, state.PeerID)
+		}
+	}
+	return peers
+}
+
+// Works out who holds every leaf from the cluster view, keyed by leaf cid
+func (inst *Instance) clusterHolders() map[string][]string {
+	holders := make(map[string][]string)
+	if inst.Cluster == nil {
+		return holders
+	}
+
+	self := inst.Host.ID().String()
+
+	inst.BlockMapsMutex.Lock()
+	leafBlocks := make(map[string][]cid.Cid, len(inst.LeafBlocks))
+	for k, v := range inst.LeafBlocks {
+		leafBlocks[k] = v
+	}
+	inst.BlockMapsMutex.Unlock()
+
+	for _, state := range inst.clusterStates() {
+		// Copies on a draining node are about to go away
+		if state.PeerID == self || state.PeerID == "" || state.Draining {
+			continue
+		}
+
+		for _, source := range inst.SourceList() {
+			leaves := leafBlocks[source.Name]
+			for _, i := range state.Holdings[source.Cid].Indices() {
+				if i < len(leaves) && leaves[i].Defined() {
+					c := leaves[i].String()
+					holders[c] = append(holders[c], state.PeerID)
+				}
+			}
+		}
+	}
+
+	return holders
+}
+
+// Periodically looks at the cluster view and flags a reallocation if the picture changed
+func (inst *Instance) replicateData(ctx context.Context) {
+	t := time.NewTicker(heartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			holdersChanged := inst.replicas.replace(inst.clusterHolders())
+			membersChanged := inst.replicas.replaceMembers(inst.liveMembers())
+			hotChanged := inst.replicas.replaceHot(inst.clusterHot())
+			inst.reputation.heartbeat(inst.clusterPeers())
+			distrustChanged := inst.replicas.replaceDistrusted(inst.distrustedPeers())
+			if holdersChanged || membersChanged || hotChanged || distrustChanged {
+				inst.reallocate()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Swaps in a new view of the cluster, returns true if it's different from the last one
+func (r *replicaSet) replace(holders map[string][]string) bool {
+	for _, ids := range holders {
+		sort.Strings(ids)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	changed := len(holders) != len(r.holders)
+	if !changed {
+		for c, ids := range holders {
+			old := r.holders[c]
+			if len(old) != len(ids) {
+				changed = true
+				break
+			}
+			for i := range ids {
+				if ids[i] != old[i] {
+					changed = true
+					break
+				}
+			}
+			if changed {
+				break
+			}
+		}
+	}
+
+	r.holders = holders
+	return changed
+}
+
+// Swaps in the live members, returns true if someone joined, left or changed their capacity
+func (r *replicaSet) replaceMembers(members []Member) bool {
+	sorted := append([]Member(nil), members...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PeerID < sorted[j].PeerID })
+	key := fmt.Sprint(sorted)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	changed := key != r.members
+	r.members = key
+	return changed
+}
+
+// Swaps in the hot leaves, returns true if a leaf got hot or cooled down
+func (r *replicaSet) replaceHot(hot map[string]int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	changed := len(hot) != len(r.hot)
+	for c := range hot {
+		if _, ok := r.hot[c]; !ok {
+			changed = true
+			break
+		}
+	}
+
+	r.hot = hot
+	return changed
+}
+
+// How hot a leaf is, 0 if it isn't
+func (r *replicaSet) hotness(c string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.hot[c]
+}
+
+// Swaps in the distrusted peers, returns true if a peer lost or won back our trust
+func (r *replicaSet) replaceDistrusted(distrusted map[string]bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	changed := len(distrusted) != len(r.distrusted)
+	for id := range distrusted {
+		if !r.distrusted[id] {
+			changed = true
+			break
+		}
+	}
+
+	r.distrusted = distrusted
+	return changed
+}
+
+func (r *replicaSet) holdersOf(c string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.holders[c]
+}
+
+// Holders of a leaf whose copies count towards the replication factor
+func (r *replicaSet) trustedHoldersOf(c string) []string {
+	return r.trusted(r.holdersOf(c))
+}
+
+// The peers out of ids whose copies count
+func (r *replicaSet) trusted(ids []string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	trusted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !r.distrusted[id] {
+			trusted = append(trusted, id)
+		}
+	}
+	return trusted
+}
+
+// Ranks a node for a given leaf, used so nodes agree on who lets go of an over replicated leaf
+func holderRank(nodeId string, c string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(nodeId))
+	h.Write([]byte(c))
+	return h.Sum64()
+}
+
+// The configured allocation strategy, rarest first if there's none
+func (inst *Instance) allocator() AllocationStrategy {
+	if inst.Allocator == nil {
+		return RarestFirstAllocation{}
+	}
+	return inst.Allocator
+}
+
+// Flags the sync loop to work out the wanted blocks again and wakes it up
+func (inst *Instance) reallocate() {
+	inst.reallocateMutex.Lock()
+	inst.needsReallocation = true
+	inst.reallocateMutex.Unlock()
+
+	inst.syncer.poke()
+}
+
+func (inst *Instance) reallocationPending() bool {
+	inst.reallocateMutex.Lock()
+	defer inst.reallocateMutex.Unlock()
+
+	return inst.needsReallocation
+}
+
+func (inst *Instance) takeReallocation() bool {
+	inst.reallocateMutex.Lock()
+	defer inst.reallocateMutex.Unlock()
+
+	needed := inst.needsReallocation
+	inst.needsReallocation = false
+	return needed
+}
+
+// Works out which blocks this node should seed so that every leaf ends up with a replication factor's worth of copies.
+//  0. Sources ingested on this node are kept until enough other nodes hold them, whatever the space.
+//  1. Keep the blocks we already want unless enough other nodes hold them and we're the one that should let go.
+//     Held blocks go first so a smaller budget evicts as few blocks as possible.
+//  2. Claim leaves that are under replicated, in the order the allocation strategy picks, until we're out of space.
+//  3. Keep or claim extra copies of hot leaves, the hottest first, within the hot budget.
+func (inst *Instance) allocateBlocks() {
+	if inst.Draining() {
+		// Keep what we have so peers can fetch it from us, but don't take anything new
+		return
+	}
+	if inst.Role() == ROLE_SEEDER {
+		inst.allocateOrigins()
+		return
+	}
+
+	inst.Status = ADJUSTING_WANTED_BLOCKS
+	log.Println("Working out which blocks to seed")
+
+	target := inst.replicationFactor()
+	self := inst.Host.ID().String()
+	// Metadata comes out of the budget first, cache doesn't since the sync loop collects it before allocating
+	size := int64(inst.StorageSize())
+	freeStorage := size - inst.StorageReport().Metadata
+	hotBudget := size * int64(inst.Config.HotBudget) / 100
+
+	inst.BlockMapsMutex.Lock()
+	previous := make(map[string][]int, len(inst.BlocksToSeed))
+	for k, v := range inst.BlocksToSeed {
+		previous[k] = v
+	}
+	leafBlocks := make(map[string][]cid.Cid, len(inst.LeafBlocks))
+	for k, v := range inst.LeafBlocks {
+		leafBlocks[k] = v
+	}
+	dataLeaves := make(map[string]int, len(inst.layouts))
+	for k, v := range inst.layouts {
+		dataLeaves[k] = v.DataLeaves
+	}
+	origins := make(map[string]bool, len(inst.origins))
+	for k, v := range inst.origins {
+		origins[k] = v
+	}
+	held := make(map[string]map[int]bool, len(inst.BlocksSeeding))
+	for k, v := range inst.BlocksSeeding {
+		held[k] = make(map[int]bool, len(v))
+		for _, i := range v {
+			held[k][i] = true
+		}
+	}
+	inst.BlockMapsMutex.Unlock()
+
+	sources := inst.SourceList()
+	members := inst.liveMembers()
+	newBlocksToSeed := make(map[string][]int, len(sources))
+	wanted := make(map[string]map[int]bool, len(sources))
+	// How many members of a stripe we can take, so a stripe spreads over as many nodes as it can
+	stripeLimit := make(map[string]int)
+	stripeLoad := make(map[string]int)
+
+	every := make([]LeafCandidate, 0)
+	pinned := make([]LeafCandidate, 0)
+	kept := make([]LeafCandidate, 0)
+	candidates := make([]LeafCandidate, 0)
+	// Extra copies of hot leaves, with how hot they are
+	hot := make([]LeafCandidate, 0)
+	hotScore := make(map[string]int)
+
+	for _, source := range sources {
+		if !inst.metadata.isResolved(source.Name) {
+			// Can't allocate leaves we don't know about yet
+			continue
+		}
+
+		leaves := leafBlocks[source.Name]
+		wanted[source.Name] = make(map[int]bool)
+		for _, i := range previous[source.Name] {
+			wanted[source.Name][i] = true
+		}
+
+		// Erasure coded sources keep a single copy of every stripe member, the parity takes care of the rest
+		copies := target
+		if source.Erasure != nil {
+			copies = 1
+			stripeLimit[source.Name] = stripeSpread(source.Erasure, len(members))
+		}
+
+		for i := 0; i < len(leaves); i++ {
+			if !leaves[i].Defined() {
+				continue
+			}
+
+			size, err := inst.leafSize(source, i)
+			if err != nil {
+				continue
+			}
+
+			c := leaves[i].String()
+			// Copies on peers with a bad reputation might not be there when they're needed
+			holders := inst.replicas.trustedHoldersOf(c)
+			candidate := LeafCandidate{Source: source, Index: i, Cid: c, Size: size, Replicas: len(holders), Held: held[source.Name][i]}
+			if source.Erasure != nil {
+				candidate.Stripe = fmt.Sprintf("%s/%d", source.Name, source.Erasure.Stripe(i, dataLeaves[source.Name]))
+			}
+
+			if origins[source.Name] && len(holders) < copies {
+				// We might be the only copy, this can't wait for space to free up
+				pinned = append(pinned, candidate)
+				continue
+			}
+			every = append(every, candidate)
+
+			// Hot leaves get a few more copies on top
+			want := copies
+			if score := inst.replicas.hotness(c); score > 0 && inst.Config.HotReplicas > 0 {
+				want += inst.Config.HotReplicas
+				hotScore[c] = score
+			}
+
+			if wanted[source.Name][i] {
+				if len(holders) < copies {
+					kept = append(kept, candidate)
+					continue
+				}
+
+				// Over replicated, only the lowest ranked holders keep their copy
+				myRank := holderRank(self, c)
+				lowerRanked := 0
+				for _, h := range holders {
+					if holderRank(h, c) < myRank {
+						lowerRanked++
+					}
+				}
+				if lowerRanked < copies {
+					kept = append(kept, candidate)
+				} else if lowerRanked < want {
+					hot = append(hot, candidate)
+				}
+			} else if len(holders) < copies {
+				candidates = append(candidates, candidate)
+			} else if len(holders) < want {
+				hot = append(hot, candidate)
+			}
+		}
+	}
+
+	if placer, ok := inst.allocator().(PlacementStrategy); ok {
+		// The strategy decides on its own, whatever is held right now
+		kept = placer.Place(self, members, every, target)
+		candidates = nil
+	} else {
+		// Blocks we hold first, then the smallest, so shrinking drops as few held blocks as it can
+		sort.SliceStable(kept, func(i, j int) bool {
+			if kept[i].Held != kept[j].Held {
+				return kept[i].Held
+			}
+			return kept[i].Size < kept[j].Size
+		})
+		candidates = inst.allocator().Order(self, candidates)
+	}
+
+	for _, c := range pinned {
+		newBlocksToSeed[c.Source.Name] = append(newBlocksToSeed[c.Source.Name], c.Index)
+		freeStorage -= c.Size
+		if c.Stripe != "" {
+			stripeLoad[c.Stripe]++
+		}
+	}
+
+	for _, list := range [][]LeafCandidate{kept, candidates} {
+		for _, c := range list {
+			if freeStorage-c.Size < 0 {
+				// sadly this is too big
+				continue
+			}
+			if c.Stripe != "" && stripeLoad[c.Stripe] >= stripeLimit[c.Source.Name] {
+				// Leave the rest of the stripe to other nodes
+				continue
+			}
+
+			newBlocksToSeed[c.Source.Name] = append(newBlocksToSeed[c.Source.Name], c.Index)
+			freeStorage -= c.Size
+			if c.Stripe != "" {
+				stripeLoad[c.Stripe]++
+			}
+		}
+	}
+
+	// Extra copies we hold first, then the hottest
+	sort.SliceStable(hot, func(i, j int) bool {
+		if hot[i].Held != hot[j].Held {
+			return hot[i].Held
+		}
+		return hotScore[hot[i].Cid] > hotScore[hot[j].Cid]
+	})
+	for _, c := range hot {
+		if c.Size > hotBudget || freeStorage-c.Size < 0 || slices.Contains(newBlocksToSeed[c.Source.Name], c.Index) {
+			continue
+		}
+		if c.Stripe != "" && stripeLoad[c.Stripe] >= stripeLimit[c.Source.Name] {
+			continue
+		}
+
+		newBlocksToSeed[c.Source.Name] = append(newBlocksToSeed[c.Source.Name], c.Index)
+		freeStorage -= c.Size
+		hotBudget -= c.Size
+		if c.Stripe != "" {
+			stripeLoad[c.Stripe]++
+		}
+	}
+
+	for _, blocks := range newBlocksToSeed {
+		sort.Ints(blocks)
+	}
+
+	log.Println("Free storage after allocation", freeStorage)
+
+	// copy new blocks to seed to existing map
+	log.Println("Waiting for block mutex")
+	inst.BlockMapsMutex.Lock()
+	inst.BlocksToSeed = newBlocksToSeed
+	inst.BlockMapsMutex.Unlock()
+}
+
+// How many members of every stripe a node takes when they're spread as evenly as they can be over the members
+func stripeSpread(e *model.Erasure, members int) int {
+	if members < 1 {
+		members = 1
+	}
+	return (e.Data + e.Parity + members - 1) / members
+}
@@ -0,0 +1,239 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	bsserver "github.com/ipfs/boxo/bitswap/server"
+)
+
+const (
+	defaultMinReputation  = 0.4
+	reputationDialTimeout = 5 * time.Second
+	reputationDials       = 8 // Reputable holders we make sure we're connected to before a sync pass
+
+	// How much every kind of evidence counts towards a score, they add up to 1
+	challengeWeight    = 0.5
+	fetchWeight        = 0.3
+	availabilityWeight = 0.2
+)
+
+// PeerScore is what we think of a peer, Score goes from 0 (don't trust it) to 1.
+// A peer we know nothing about is at 0.5.
+type PeerScore struct {
+	PeerID           string
+	Score            float64
+	BlocksServed     uint64 // Blocks the peer sent us through bitswap
+	FetchFailures    uint64 // Fetches of leaves the peer claims that failed
+	FetchTimeouts    uint64 // Same, but they ran out of time
+	ChallengesPassed uint64
+	ChallengesFailed uint64 // Failed, timed out or unreachable
+	Heartbeats       uint64 // Heartbeats the peer was in the cluster view for
+	Missed           uint64 // Heartbeats it wasn't, since we first saw it
+	FirstSeen        time.Time
+	LastSeen         time.Time
+}
+
+type reputation struct {
+	mutex sync.Mutex
+	peers map[string]*PeerScore
+}
+
+func newReputation() *reputation {
+	return &reputation{peers: make(map[string]*PeerScore)}
+}
+
+// Has to be called with the mutex held
+func (r *reputation) peerLocked(id string) *PeerScore {
+	s, ok := r.peers[id]
+	if !ok {
+		s = &PeerScore{PeerID: id}
+		r.peers[id] = s
+	}
+	return s
+}
+
+func (r *reputation) update(id string, f func(s *PeerScore)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f(r.peerLocked(id))
+}
+
+// Records who was in the cluster view on a heartbeat
+func (r *reputation) heartbeat(present []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]bool, len(present))
+	for _, id := range present {
+		seen[id] = true
+		s := r.peerLocked(id)
+		if s.FirstSeen.IsZero() {
+			s.FirstSeen = now
+		}
+		s.LastSeen = now
+		s.Heartbeats++
+	}
+	for id, s := range r.peers {
+		if !seen[id] && !s.FirstSeen.IsZero() {
+			s.Missed++
+		}
+	}
+}
+
+// Every kind of evidence is a ratio that starts at 1/2, so a couple of bad answers don't sink a peer straight away
+func ratio(good uint64, bad uint64) float64 {
+	return float64(good+1) / float64(good+bad+2)
+}
+
+func (s PeerScore) score() float64 {
+	return challengeWeight*ratio(s.ChallengesPassed, s.ChallengesFailed) +
+		fetchWeight*ratio(s.BlocksServed, s.FetchFailures+s.FetchTimeouts) +
+		availabilityWeight*ratio(s.Heartbeats, s.Missed)
+}
+
+// Adds in what the challenges found, they're kept by the challenge log
+func scored(s PeerScore, challenges map[string]ChallengeRecord) PeerScore {
+	if c, ok := challenges[s.PeerID]; ok {
+		s.ChallengesPassed = c.Passed
+		s.ChallengesFailed = c.Failed + c.Timeouts + c.Unreachable
+	}
+	s.Score = s.score()
+	return s
+}
+
+// Reputation returns the score of every peer we know something about, the best first
+func (inst *Instance) Reputation() []PeerScore {
+	challenges := inst.ChallengeResults()
+
+	inst.reputation.mutex.Lock()
+	scores := make([]PeerScore, 0, len(inst.reputation.peers))
+	for _, s := range inst.reputation.peers {
+		scores = append(scores, *s)
+	}
+	for id := range challenges {
+		if _, ok := inst.reputation.peers[id]; !ok {
+			scores = append(scores, PeerScore{PeerID: id})
+		}
+	}
+	inst.reputation.mutex.Unlock()
+
+	for i := range scores {
+		scores[i] = scored(scores[i], challenges)
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		return scores[i].PeerID < scores[j].PeerID
+	})
+	return scores
+}
+
+// The scores of every peer, by peer id
+func (inst *Instance) peerScores() map[string]float64 {
+	scores := make(map[string]float64)
+	for _, s := range inst.Reputation() {
+		scores[s.PeerID] = s.Score
+	}
+	return scores
+}
+
+// Peers whose copies don't count towards the replication factor
+func (inst *Instance) distrustedPeers() map[string]bool {
+	distrusted := make(map[string]bool)
+	for id, score := range inst.peerScores() {
+		if score < inst.Config.MinReputation {
+			distrusted[id] = true
+		}
+	}
+	return distrusted
+}
+
+// Blames the peers claiming a leaf we couldn't fetch.
+// Only the ones we're connected to were asked for it, and a fetch we called off isn't anyone's fault.
+func (inst *Instance) fetchFailed(c string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	timeout := errors.Is(err, context.DeadlineExceeded)
+	for _, id := range inst.replicas.holdersOf(c) {
+		p, err := peer.Decode(id)
+		if err != nil || inst.Host.Network().Connectedness(p) != network.Connected {
+			continue
+		}
+
+		inst.reputation.update(id, func(s *PeerScore) {
+			if timeout {
+				s.FetchTimeouts++
+			} else {
+				s.FetchFailures++
+			}
+		})
+	}
+}
+
+// Steers bitswap towards the best holders of the leaves we're about to fetch, it asks every peer we're connected to.
+// Reputable holders get dialed, the best first. Holders below the minimum reputation are never dialed for a fetch,
+// but connections we already have stay up since they carry serving, gossip, the DHT and challenges too.
+func (inst *Instance) preferReputable(ctx context.Context, leaves []string) {
+	scores := inst.peerScores()
+	self := inst.Host.ID().String()
+
+	holders := make(map[string]bool)
+	for _, c := range leaves {
+		for _, id := range inst.replicas.holdersOf(c) {
+			if id != self {
+				holders[id] = true
+			}
+		}
+	}
+
+	ranked := make([]string, 0, len(holders))
+	for id := range holders {
+		if _, ok := scores[id]; !ok {
+			scores[id] = PeerScore{}.score()
+		}
+		if scores[id] >= inst.Config.MinReputation {
+			ranked = append(ranked, id)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool { return scores[ranked[i]] > scores[ranked[j]] })
+
+	dials := 0
+	for _, id := range ranked {
+		if dials == reputationDials {
+			break
+		}
+		p, err := peer.Decode(id)
+		if err != nil || inst.Host.Network().Connectedness(p) == network.Connected {
+			continue
+		}
+
+		dials++
+		dctx, cancel := context.WithTimeout(ctx, reputationDialTimeout)
+		// The peerstore has the addresses of peers we've come across
+		inst.Host.Connect(dctx, peer.AddrInfo{ID: p})
+		cancel()
+	}
+}
+
+// reputationNotifier credits peers for the blocks they send us and passes them on to the bitswap server like bitswap does
+type reputationNotifier struct {
+	reputation *reputation
+	server     *bsserver.Server
+}
+
+func (n reputationNotifier) ReceivedBlocks(p peer.ID, blks []blocks.Block) {
+	n.reputation.update(p.String(), func(s *PeerScore) { s.BlocksServed += uint64(len(blks)) })
+	n.server.ReceivedBlocks(p, blks)
+}
@@ -0,0 +1,60 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+func TestReputation_Challenges(t *testing.T) {
+	ctx := context.Background()
+	content := make([]byte, 20*1024)
+	rand.New(rand.NewSource(4)).Read(content)
+
+	honest := offlineInstance(t)
+	_, err := honest.AddSource(ctx, "data", bytes.NewReader(content))
+	assert.Nil(t, err)
+	leaves := honest.LeafBlocks["data"]
+
+	// Claims the same leaves but never stored them
+	liar := offlineInstance(t)
+
+	verifier := offlineInstance(t)
+	holdLeaves(t, honest, verifier, leaves[:3])
+	for _, p := range []*ipfs.Instance{honest, liar} {
+		err := verifier.Host.Connect(ctx, peer.AddrInfo{ID: p.Host.ID(), Addrs: p.Host.Addrs()})
+		assert.Nil(t, err)
+	}
+
+	for _, leaf := range leaves[:3] {
+		result, err := verifier.Challenge(ctx, honest.Host.ID(), leaf)
+		assert.Nil(t, err)
+		assert.Equal(t, ipfs.CHALLENGE_PASSED, result)
+
+		result, err = verifier.Challenge(ctx, liar.Host.ID(), leaf)
+		assert.Nil(t, err)
+		assert.Equal(t, ipfs.CHALLENGE_FAILED, result)
+	}
+
+	scores := verifier.Reputation()
+	assert.Len(t, scores, 2)
+	assert.Equal(t, honest.Host.ID().String(), scores[0].PeerID)
+	assert.Equal(t, uint64(3), scores[0].ChallengesPassed)
+	assert.Greater(t, scores[0].Score, 0.5)
+
+	assert.Equal(t, liar.Host.ID().String(), scores[1].PeerID)
+	assert.Equal(t, uint64(3), scores[1].ChallengesFailed)
+	// Low enough that its copies don't count anymore
+	assert.Less(t, scores[1].Score, ipfs.DefaultConfig().MinReputation)
+
+	// A challenge we can't check ourselves doesn't count against anyone
+	_, err = verifier.Challenge(ctx, liar.Host.ID(), blocks.NewBlock([]byte("nobody has this")).Cid())
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(3), verifier.Reputation()[1].ChallengesFailed)
+}
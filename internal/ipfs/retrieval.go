@@ -0,0 +1,146 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+)
+
+// OpenCid returns a reader over the UnixFS file rooted at c.
+// Blocks we don't hold are fetched from peers through bitswap as the reader gets to them.
+// If c is an erasure coded source, leaves nobody hands over are rebuilt from the rest of their stripe.
+func (inst *Instance) OpenCid(ctx context.Context, c cid.Cid) (uio.DagReader, error) {
+	if err := inst.checkRetrieval(); err != nil {
+		return nil, err
+	}
+
+	source, _ := inst.erasureSource(c)
+	dserv := inst.sourceDag(ctx, source)
+
+	node, err := dserv.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return uio.NewDagReader(ctx, node, dserv)
+}
+
+// The erasure coded source rooted at c, if there is one
+func (inst *Instance) erasureSource(c cid.Cid) (Source, bool) {
+	for _, source := range inst.SourceList() {
+		if source.Erasure != nil && source.Cid == c.String() {
+			return source, true
+		}
+	}
+	return Source{}, false
+}
+
+// The nodes of a source come through here, so leaves of erasure coded sources get rebuilt when they have to be and every read is counted
+func (inst *Instance) sourceDag(ctx context.Context, source Source) format.DAGService {
+	var ng format.NodeGetter = merkledag.NewSession(ctx, merkledag.NewDAGService(inst.Bservice))
+	if source.Erasure != nil {
+		inst.BlockMapsMutex.Lock()
+		layout, resolved := inst.layouts[source.Name]
+		inst.BlockMapsMutex.Unlock()
+
+		if resolved {
+			ng = newStripeGetterWithLayout(ng, source, layout)
+		} else {
+			ng = NewStripeGetter(ng, source)
+		}
+	}
+	return merkledag.NewReadOnlyDagService(&accessGetter{ng, inst.access})
+}
+
+// Light nodes don't talk bitswap so they can't retrieve anything
+func (inst *Instance) checkRetrieval() error {
+	if !inst.exchangesBlocks() {
+		return ErrRoleNotAllowed
+	}
+	if inst.Bservice == nil {
+		return errors.New("ipfs instance isn't started")
+	}
+	return nil
+}
+
+// Stat describes whatever is at path inside a source
+func (inst *Instance) Stat(ctx context.Context, source Source, path string) (Entry, error) {
+	if err := inst.checkRetrieval(); err != nil {
+		return Entry{}, err
+	}
+
+	name, nd, err := resolvePath(ctx, inst.sourceDag(ctx, source), source, path)
+	if err != nil {
+		return Entry{}, err
+	}
+	return entryOf(name, nd)
+}
+
+// ListEntries lists the directory at path inside a source, in the order the DAG has them
+func (inst *Instance) ListEntries(ctx context.Context, source Source, path string) ([]Entry, error) {
+	if err := inst.checkRetrieval(); err != nil {
+		return nil, err
+	}
+
+	dserv := inst.sourceDag(ctx, source)
+	_, nd, err := resolvePath(ctx, dserv, source, path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if errors.Is(err, uio.ErrNotADir) {
+		return nil, ErrNotDirectory
+	} else if err != nil {
+		return nil, err
+	}
+
+	links, err := dir.Links(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([]cid.Cid, len(links))
+	for i, l := range links {
+		cids[i] = l.Cid
+	}
+	// Need the children themselves to tell files from directories
+	nodes := make(map[cid.Cid]format.Node, len(links))
+	if err := getBatch(ctx, dserv, cids, nodes, metadataRetries, nil); err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(links))
+	for _, l := range links {
+		entry, err := entryOf(l.Name, nodes[l.Cid])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// OpenPath returns a reader over the file at path inside a source, see OpenCid
+func (inst *Instance) OpenPath(ctx context.Context, source Source, path string) (uio.DagReader, error) {
+	if err := inst.checkRetrieval(); err != nil {
+		return nil, err
+	}
+
+	dserv := inst.sourceDag(ctx, source)
+	_, nd, err := resolvePath(ctx, dserv, source, path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := uio.NewDagReader(ctx, nd, dserv)
+	if errors.Is(err, uio.ErrIsDir) {
+		return nil, ErrIsDirectory
+	}
+	return r, err
+}
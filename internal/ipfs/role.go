@@ -0,0 +1,82 @@
+package ipfs
+
+import (
+	"errors"
+	"log"
+	"sort"
+)
+
+// What a node does in the cluster, any number of nodes can take any role
+const (
+	ROLE_SEEDER  = "seeder"  // Imports the files in its sources dir, publishes them and seeds every block of what it published
+	ROLE_STORAGE = "storage" // Takes a share of every source and keeps the cluster at the replication factor
+	ROLE_GATEWAY = "gateway" // Serves sources over HTTP, fetching blocks from the cluster as needed, stores no share
+	ROLE_LIGHT   = "light"   // Follows the registry and the cluster without exchanging any blocks
+)
+
+var ErrRoleNotAllowed = errors.New("not allowed for this node's role")
+
+func validRole(role string) bool {
+	switch role {
+	case ROLE_SEEDER, ROLE_STORAGE, ROLE_GATEWAY, ROLE_LIGHT:
+		return true
+	}
+	return false
+}
+
+// Role returns the configured role, storage if none is set
+func (inst *Instance) Role() string {
+	if inst.Config.Role == "" {
+		return ROLE_STORAGE
+	}
+	return inst.Config.Role
+}
+
+// Seeders and storage nodes hold blocks, so they can take in new sources
+func (inst *Instance) canIngest() bool {
+	role := inst.Role()
+	return role == ROLE_SEEDER || role == ROLE_STORAGE
+}
+
+// Everyone but light nodes talks bitswap
+func (inst *Instance) exchangesBlocks() bool {
+	return inst.Role() != ROLE_LIGHT
+}
+
+// Gateways and light nodes don't keep a share so they don't need the metadata up front
+func (inst *Instance) keepsShare() bool {
+	role := inst.Role()
+	return role == ROLE_SEEDER || role == ROLE_STORAGE
+}
+
+// A seeder wants every block of the sources it published and nothing else
+func (inst *Instance) allocateOrigins() {
+	inst.Status = ADJUSTING_WANTED_BLOCKS
+
+	inst.BlockMapsMutex.Lock()
+	defer inst.BlockMapsMutex.Unlock()
+
+	newBlocksToSeed := make(map[string][]int, len(inst.origins))
+	for name := range inst.origins {
+		leaves := inst.LeafBlocks[name]
+		all := make([]int, 0, len(leaves))
+		for i, leaf := range leaves {
+			if leaf.Defined() {
+				all = append(all, i)
+			}
+		}
+		sort.Ints(all)
+		newBlocksToSeed[name] = all
+	}
+
+	log.Println("Seeding every block of", len(newBlocksToSeed), "published sources")
+	inst.BlocksToSeed = newBlocksToSeed
+}
+
+// The storage this node offers the cluster, only storage nodes take a share
+func (inst *Instance) capacity() int64 {
+	if inst.Role() != ROLE_STORAGE || inst.Draining() {
+		return 0
+	}
+	return int64(inst.StorageSize())
+}
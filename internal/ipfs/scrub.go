@@ -0,0 +1,192 @@
+package ipfs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	defaultScrubRate     = 20
+	defaultScrubInterval = time.Hour
+	scrubRepairTimeout   = 30 * time.Second
+)
+
+// ScrubStats is what the scrubber found in the blockstore
+type ScrubStats struct {
+	Checked   uint64 // Blocks re-hashed, over every pass
+	Corrupt   uint64 // Blocks whose bytes didn't hash to their CID
+	Repaired  uint64 // Corrupt blocks we got back from peers
+	Failed    uint64 // Corrupt blocks nobody handed over, the sync engine tries again later
+	Passes    uint64
+	Scrubbing bool
+	LastPass  time.Time // When the last full pass finished
+}
+
+type scrubber struct {
+	mutex sync.Mutex
+	stats ScrubStats
+}
+
+func (s *scrubber) update(f func(s *ScrubStats)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(&s.stats)
+}
+
+// ScrubStats returns a snapshot of what the scrubber has been up to
+func (inst *Instance) ScrubStats() ScrubStats {
+	inst.scrubber.mutex.Lock()
+	defer inst.scrubber.mutex.Unlock()
+
+	return inst.scrubber.stats
+}
+
+func (inst *Instance) scrubRate() int {
+	if inst.Config.ScrubRate > 0 {
+		return inst.Config.ScrubRate
+	}
+	return defaultScrubRate
+}
+
+// Scrub re-hashes every block in the blockstore, no faster than the scrub rate.
+// Corrupt blocks are deleted, the pinned ones are fetched again through bitswap.
+func (inst *Instance) Scrub(ctx context.Context) error {
+	keys, err := inst.Bstore.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+	listed := make([]cid.Cid, 0)
+	for c := range keys {
+		listed = append(listed, c)
+	}
+
+	inst.scrubber.update(func(s *ScrubStats) { s.Scrubbing = true })
+	defer inst.scrubber.update(func(s *ScrubStats) { s.Scrubbing = false })
+
+	t := time.NewTicker(time.Second / time.Duration(inst.scrubRate()))
+	defer t.Stop()
+
+	for _, c := range listed {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if !inst.scrubBlock(ctx, c) {
+			continue
+		}
+		inst.scrubber.update(func(s *ScrubStats) { s.Corrupt++ })
+		log.Println("Scrubber found corrupt block", c)
+
+		if inst.repairBlock(ctx, c) {
+			inst.scrubber.update(func(s *ScrubStats) { s.Repaired++ })
+		} else {
+			inst.scrubber.update(func(s *ScrubStats) { s.Failed++ })
+		}
+	}
+
+	inst.scrubber.update(func(s *ScrubStats) {
+		s.Passes++
+		s.LastPass = time.Now()
+	})
+	return nil
+}
+
+// Checks a single block, returns true if it's corrupt
+func (inst *Instance) scrubBlock(ctx context.Context, c cid.Cid) bool {
+	blk, err := inst.Bstore.Get(ctx, c)
+	if err != nil {
+		// Gone already, the GC probably got to it
+		return false
+	}
+	inst.scrubber.update(func(s *ScrubStats) { s.Checked++ })
+
+	// The blockstore only keeps multihashes so the codec doesn't matter
+	sum, err := c.Prefix().Sum(blk.RawData())
+	return err != nil || string(sum.Hash()) != string(c.Hash())
+}
+
+// Deletes a corrupt block and gets it back from peers if something pins it, returns true if it's back
+func (inst *Instance) repairBlock(ctx context.Context, c cid.Cid) bool {
+	if err := inst.Bstore.DeleteBlock(ctx, c); err != nil {
+		log.Println("Failed to delete corrupt block", c, err)
+		return false
+	}
+
+	marked, err := inst.markPinned(ctx)
+	if err != nil || !marked[string(c.Hash())] {
+		// Nobody needs it, deleting it is all there is to do
+		return err == nil
+	}
+
+	// Don't say we're seeding it until it's back
+	dropped := inst.dropHeld(c)
+
+	fctx, cancel := context.WithTimeout(ctx, scrubRepairTimeout)
+	defer cancel()
+	if _, err := inst.Bservice.GetBlock(fctx, c); err != nil {
+		log.Println("Couldn't repair block", c, err)
+		// Still wanted, the sync engine fetches it once peers have it
+		inst.syncer.poke()
+		return false
+	}
+
+	inst.BlockMapsMutex.Lock()
+	for name, indices := range dropped {
+		if _, ok := inst.LeafBlocks[name]; ok {
+			for _, i := range indices {
+				inst.BlocksSeeding[name] = insertIndex(inst.BlocksSeeding[name], i)
+			}
+		}
+	}
+	inst.BlockMapsMutex.Unlock()
+	return true
+}
+
+// Takes every leaf with c's multihash out of BlocksSeeding, returns the indices by source
+func (inst *Instance) dropHeld(c cid.Cid) map[string][]int {
+	inst.BlockMapsMutex.Lock()
+	defer inst.BlockMapsMutex.Unlock()
+
+	dropped := make(map[string][]int)
+	for name, seeding := range inst.BlocksSeeding {
+		leaves := inst.LeafBlocks[name]
+		held := make([]int, 0, len(seeding))
+		for _, i := range seeding {
+			if i < len(leaves) && string(leaves[i].Hash()) == string(c.Hash()) {
+				dropped[name] = append(dropped[name], i)
+				continue
+			}
+			held = append(held, i)
+		}
+		inst.BlocksSeeding[name] = held
+	}
+	return dropped
+}
+
+// Scrubs every scrub interval until ctx is done
+func (inst *Instance) runScrub(ctx context.Context) {
+	interval := inst.Config.ScrubInterval
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := inst.Scrub(ctx); err != nil && ctx.Err() == nil {
+				log.Println("Scrub failed:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
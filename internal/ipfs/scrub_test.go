@@ -0,0 +1,72 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/boxo/blockservice"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+)
+
+// Overwrites the bytes of a block behind the blockstore's back
+func corrupt(t *testing.T, inst *ipfs.Instance, c cid.Cid) {
+	key := datastore.NewKey("/blocks").Child(dshelp.MultihashToDsKey(c.Hash()))
+	assert.Nil(t, inst.Datastore.Put(context.Background(), key, []byte("rotten")))
+}
+
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	inst := offlineInstance(t)
+	inst.Config.ScrubRate = 10000
+
+	content := make([]byte, 4*4096)
+	rand.New(rand.NewSource(1)).Read(content)
+	source, err := inst.AddSource(ctx, "data", bytes.NewReader(content))
+	assert.Nil(t, err)
+	leaf := inst.Pins()["data"].Direct[1]
+
+	// A clean blockstore has nothing to report, 4 leaves and the root
+	assert.Nil(t, inst.Scrub(ctx))
+	stats := inst.ScrubStats()
+	assert.Equal(t, uint64(5), stats.Checked)
+	assert.Equal(t, uint64(0), stats.Corrupt)
+	assert.Equal(t, uint64(1), stats.Passes)
+	assert.False(t, stats.LastPass.IsZero())
+
+	// A peer still has the good copy
+	peer := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+	good, err := inst.Bstore.Get(ctx, leaf)
+	assert.Nil(t, err)
+	assert.Nil(t, peer.Put(ctx, good))
+	inst.Bservice = blockservice.New(inst.Bstore, offline.Exchange(peer))
+
+	corrupt(t, inst, leaf)
+	assert.Nil(t, inst.Scrub(ctx))
+	stats = inst.ScrubStats()
+	assert.Equal(t, uint64(1), stats.Corrupt)
+	assert.Equal(t, uint64(1), stats.Repaired)
+	got, err := inst.Bstore.Get(ctx, leaf)
+	assert.Nil(t, err)
+	assert.Equal(t, good.RawData(), got.RawData())
+	assert.Equal(t, 4, inst.LocalState().Holdings[source.Cid].Count())
+
+	// Nobody has it this time, it's gone until the sync engine gets it back
+	inst.Bservice = blockservice.New(inst.Bstore, offline.Exchange(inst.Bstore))
+	corrupt(t, inst, leaf)
+	assert.Nil(t, inst.Scrub(ctx))
+	stats = inst.ScrubStats()
+	assert.Equal(t, uint64(2), stats.Corrupt)
+	assert.Equal(t, uint64(1), stats.Failed)
+	has, _ := inst.Bstore.Has(ctx, leaf)
+	assert.False(t, has)
+	assert.Equal(t, 3, inst.LocalState().Holdings[source.Cid].Count())
+}
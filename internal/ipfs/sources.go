@@ -0,0 +1,356 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+
+	"github.com/ipfs/boxo/blockservice"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+
+	"openmesh.network/aggregationpoc/internal/model"
+	"openmesh.network/aggregationpoc/internal/registry"
+)
+
+var ErrSourceExists = errors.New("a source with that name already exists")
+var ErrSourceNotFound = errors.New("source not found")
+var ErrOverQuota = errors.New("source doesn't fit in the storage size")
+
+// countingReader keeps track of how many bytes went through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// quotaReader fails once more than limit bytes went through it
+type quotaReader struct {
+	r     io.Reader
+	limit int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.limit -= int64(n)
+	if q.limit < 0 {
+		return n, ErrOverQuota
+	}
+	return n, err
+}
+
+// ImportSource chunks r with the chunker described by spec into a UnixFS DAG in dserv and describes it as a source.
+// The source records the chunker and the size of every leaf, and is erasure coded if data and parity are set.
+func ImportSource(ctx context.Context, dserv format.DAGService, name string, r io.Reader, spec string, data int, parity int) (Source, error) {
+	counter := &countingReader{r: r}
+	root, _, err := ImportDAG(dserv, counter, spec)
+	if err != nil {
+		return Source{}, err
+	}
+
+	return describeSource(ctx, dserv, name, root, counter.n, spec, data, parity)
+}
+
+// Describes the DAG under root that was just imported into dserv as a source
+func describeSource(ctx context.Context, dserv format.DAGService, name string, root cid.Cid, size int64, spec string, data int, parity int) (Source, error) {
+	layout, err := walkLeaves(ctx, dserv, root, 0, nil)
+	if err != nil {
+		return Source{}, err
+	}
+
+	source := Source{Name: name, Size: size, Cid: root.String(), Chunker: spec, LeafSizes: layout.LeafSizes}
+	for i, leafSize := range source.LeafSizes {
+		if leafSize < 0 {
+			// The root is the only leaf
+			source.LeafSizes[i] = size
+		}
+	}
+
+	if data > 0 && parity > 0 {
+		source.Erasure, err = EncodeErasure(ctx, dserv, root, data, parity)
+		if err != nil {
+			return Source{}, err
+		}
+	}
+
+	return source, nil
+}
+
+// Imports data ingested on this node with the configured chunker and erasure coding, every block is staged under stage
+func (inst *Instance) importSource(ctx context.Context, name string, r io.Reader, stage int) (Source, error) {
+	// NOTE Might have to change this... it used to use an offline blockservice which could be the correct approach here
+	dserv := &pinningDAG{merkledag.NewDAGService(inst.Bservice), inst.pins, stage}
+	return ImportSource(ctx, dserv, name, r, inst.chunker(), inst.Config.ErasureData, inst.Config.ErasureParity)
+}
+
+// Same as importSource for a directory on disk
+func (inst *Instance) importDirectory(ctx context.Context, dir string, stage int) (Source, error) {
+	dserv := &pinningDAG{merkledag.NewDAGService(inst.Bservice), inst.pins, stage}
+	return ImportDirectory(ctx, dserv, filepath.Base(dir), dir, inst.chunker(), inst.Config.ErasureData, inst.Config.ErasureParity)
+}
+
+// The configured chunker, the default one if there's none
+func (inst *Instance) chunker() string {
+	if inst.Config.Chunker == "" {
+		return model.DefaultChunker
+	}
+	return inst.Config.Chunker
+}
+
+// SourceList returns a snapshot of the sources the node knows about, it's safe to call while sources are being added
+func (inst *Instance) SourceList() []Source {
+	inst.SourcesMutex.Lock()
+	defer inst.SourcesMutex.Unlock()
+
+	return append([]Source(nil), inst.Sources...)
+}
+
+// SourceByName looks up a source the node knows about
+func (inst *Instance) SourceByName(name string) (Source, error) {
+	for _, s := range inst.SourceList() {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+
+	return Source{}, ErrSourceNotFound
+}
+
+// Adds a source to the list and sets up its block maps, returns false if a source with that name is already known
+func (inst *Instance) registerSource(source Source) bool {
+	inst.SourcesMutex.Lock()
+	defer inst.SourcesMutex.Unlock()
+
+	for _, s := range inst.Sources {
+		if s.Name == source.Name {
+			if s.Cid != source.Cid {
+				log.Println("Ignoring source", source.Name, source.Cid, "it clashes with", s.Cid)
+			}
+			return false
+		}
+	}
+
+	inst.BlockMapsMutex.Lock()
+	inst.BlocksToSeed[source.Name] = make([]int, 0)
+	inst.BlocksSeeding[source.Name] = make([]int, 0)
+	inst.BlockMapsMutex.Unlock()
+	inst.pins.pinRecursive(source.Name, sourceRoots(source)...)
+
+	// Copy on write so snapshots handed out by SourceList don't change under anyone
+	inst.Sources = append(append([]Source(nil), inst.Sources...), source)
+	return true
+}
+
+// Loads the sources that are already in the registry
+func (inst *Instance) loadSources(ctx context.Context) {
+	if inst.Registry == nil {
+		return
+	}
+
+	sources, err := inst.Registry.List(ctx)
+	if err != nil {
+		log.Println("Failed to list sources, waiting for the registry to catch up:", err)
+		return
+	}
+
+	for _, source := range sources {
+		inst.registerSource(source)
+	}
+}
+
+// Follows the registry, fetching metadata for new sources and dropping removed ones
+func (inst *Instance) watchRegistry(ctx context.Context) {
+	if inst.Registry == nil {
+		return
+	}
+
+	for event := range inst.Registry.Watch(ctx) {
+		source := event.Source
+
+		switch event.Type {
+		case registry.SOURCE_ADDED:
+			if _, err := cid.Parse(source.Cid); err != nil {
+				log.Println("Ignoring source", source.Name, "with bad cid", source.Cid)
+				continue
+			}
+
+			if !inst.registerSource(source) {
+				continue
+			}
+
+			log.Println("Registry added source", source.Name)
+
+			if !inst.keepsShare() {
+				continue
+			}
+
+			inst.goRun(func() {
+				dserv := merkledag.NewReadOnlyDagService(merkledag.NewSession(ctx, merkledag.NewDAGService(inst.Bservice)))
+				if inst.fetchMetadata(ctx, dserv, source) == nil {
+					inst.reallocate()
+				}
+			})
+		case registry.SOURCE_REMOVED:
+			log.Println("Registry removed source", source.Name)
+			inst.unregisterSource(ctx, source.Name)
+		}
+	}
+}
+
+// Drops a source and the blocks we were seeding for it
+func (inst *Instance) unregisterSource(ctx context.Context, name string) {
+	inst.SourcesMutex.Lock()
+	sources := make([]Source, 0, len(inst.Sources))
+	for _, s := range inst.Sources {
+		if s.Name != name {
+			sources = append(sources, s)
+		}
+	}
+	inst.Sources = sources
+	inst.SourcesMutex.Unlock()
+
+	inst.BlockMapsMutex.Lock()
+	delete(inst.LeafBlocks, name)
+	delete(inst.layouts, name)
+	delete(inst.BlocksToSeed, name)
+	delete(inst.BlocksSeeding, name)
+	delete(inst.origins, name)
+	inst.BlockMapsMutex.Unlock()
+	inst.metadata.remove(name)
+	inst.pins.unpin(name)
+
+	// Blocks another source shares stay pinned, this outlives whoever asked for the removal
+	gctx := context.WithoutCancel(ctx)
+	inst.goRun(func() {
+		if _, err := inst.CollectGarbage(gctx, GC_REMOVED); err != nil {
+			log.Println("GC failed:", err)
+		}
+	})
+
+	inst.reallocate()
+}
+
+// Adds a source whose blocks are all stored locally to the registry, registers it and seeds every block until the cluster has enough copies.
+// The registry goes first so nothing is left behind locally when it turns the source down.
+func (inst *Instance) publishSource(ctx context.Context, source Source) error {
+	// Everything was just written locally so there's no need to go to the network
+	dserv := merkledag.NewDAGService(blockservice.New(inst.Bstore, offline.Exchange(inst.Bstore)))
+	layout, err := collectLeaves(ctx, dserv, source)
+	if err != nil {
+		return err
+	}
+
+	if existing, err := inst.SourceByName(source.Name); err == nil && existing.Cid != source.Cid {
+		return ErrSourceExists
+	}
+	if inst.Registry != nil {
+		if err := inst.Registry.Add(ctx, source); err != nil {
+			return err
+		}
+	}
+
+	if !inst.registerSource(source) {
+		// Fine if it's the exact same source, the registry might have told us about it first
+		if existing, _ := inst.SourceByName(source.Name); existing.Cid != source.Cid {
+			return ErrSourceExists
+		}
+	}
+
+	all := make([]int, len(layout.Leaves))
+	for i := range all {
+		all[i] = i
+	}
+
+	inst.BlockMapsMutex.Lock()
+	inst.setLayout(source.Name, layout)
+	inst.BlocksToSeed[source.Name] = all
+	inst.BlocksSeeding[source.Name] = append([]int(nil), all...)
+	inst.origins[source.Name] = true
+	inst.BlockMapsMutex.Unlock()
+	inst.metadata.resolved(source.Name, len(layout.Leaves))
+	return nil
+}
+
+// AddSource chunks the data with the same parameters as the seed server, stores it and starts seeding every block.
+// Peers find out about it through the registry and include it in their allocation.
+func (inst *Instance) AddSource(ctx context.Context, name string, r io.Reader) (Source, error) {
+	if !inst.canIngest() {
+		return Source{}, ErrRoleNotAllowed
+	}
+	if inst.Draining() {
+		return Source{}, ErrDraining
+	}
+
+	if err := checkSourceName(name); err != nil {
+		return Source{}, err
+	}
+	if inst.Bservice == nil {
+		return Source{}, errors.New("ipfs instance isn't started")
+	}
+	if _, err := inst.SourceByName(name); err == nil {
+		return Source{}, ErrSourceExists
+	}
+
+	// We keep all of it until the cluster has copies so it has to fit next to what we already hold
+	r = &quotaReader{r: r, limit: inst.ingestRoom()}
+
+	// The blocks are pinned as they're written, the source's own pins take over once it's published
+	stage := inst.pins.newStage()
+	defer inst.pins.unstage(stage)
+	source, err := inst.importSource(ctx, name, r, stage)
+	if err != nil {
+		return Source{}, err
+	}
+
+	defer inst.pinLock()()
+	if err := inst.publishSource(ctx, source); err != nil {
+		return Source{}, err
+	}
+
+	log.Println("Ingested source", name, source.Cid, source.Size/1024, "KB")
+
+	inst.reallocate()
+	return source, nil
+}
+
+// Bytes a new source can take up, cache doesn't count since the GC can take it back.
+// Parity of erasure coded sources comes on top of this.
+func (inst *Instance) ingestRoom() int64 {
+	report := inst.StorageReport()
+	return report.Quota - report.Leaves - report.Metadata
+}
+
+// Source names end up in paths so they can't have slashes or be hidden
+func checkSourceName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || name[0] == '.' {
+		return errors.New("invalid source name")
+	}
+	return nil
+}
+
+// RemoveSource takes a source out of the registry, every node drops its blocks when it sees the change
+func (inst *Instance) RemoveSource(ctx context.Context, name string) error {
+	if _, err := inst.SourceByName(name); err != nil {
+		return err
+	}
+
+	if inst.Registry != nil {
+		if err := inst.Registry.Remove(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	inst.unregisterSource(ctx, name)
+	return nil
+}
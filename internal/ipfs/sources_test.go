@@ -0,0 +1,179 @@
+package ipfs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/blockservice"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/ipfs"
+	"openmesh.network/aggregationpoc/internal/model"
+	"openmesh.network/aggregationpoc/internal/registry"
+)
+
+// An instance with an in-memory blockstore that never goes to the network
+func offlineInstance(t *testing.T) *ipfs.Instance {
+	t.Setenv("XNODE_IP", "127.0.0.1")
+	conf := ipfs.DefaultConfig()
+	conf.Datastore = ipfs.DATASTORE_MEMORY
+	conf.Chunker = "size-4096"
+	inst := ipfs.NewInstance(conf)
+	t.Cleanup(func() { inst.Host.Close() })
+	inst.Bservice = blockservice.New(inst.Bstore, offline.Exchange(inst.Bstore))
+	return inst
+}
+
+func TestImportSource(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	content := make([]byte, 1024*1024+123)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	for _, spec := range []string{"size-131072", "size-4096", "rabin-16384-65536-131072", "buzhash"} {
+		source, err := ipfs.ImportSource(ctx, dserv, "test", bytes.NewReader(content), spec, 0, 0)
+		assert.Nil(t, err, spec)
+		assert.Equal(t, spec, source.Chunker)
+		assert.Equal(t, int64(len(content)), source.Size)
+		assert.Nil(t, source.Erasure)
+
+		// The leaf table adds up to the data and is what the block math goes by
+		total := int64(0)
+		for i, size := range source.LeafSizes {
+			total += size
+			got, err := source.BlockSize(i)
+			assert.Nil(t, err)
+			assert.Equal(t, size, got)
+		}
+		assert.Equal(t, source.Size, total, spec)
+		assert.Equal(t, int64(len(source.LeafSizes)), source.BlockCount())
+	}
+
+	// The same chunker always gives the same source
+	a, _ := ipfs.ImportSource(ctx, dserv, "a", bytes.NewReader(content), "size-4096", 0, 0)
+	b, _ := ipfs.ImportSource(ctx, dserv, "a", bytes.NewReader(content), "size-4096", 0, 0)
+	assert.True(t, a.Same(b))
+	c, _ := ipfs.ImportSource(ctx, dserv, "a", bytes.NewReader(content), "size-8192", 0, 0)
+	assert.NotEqual(t, a.Cid, c.Cid)
+	assert.False(t, a.Same(c))
+
+	// A single leaf is the whole source
+	small, err := ipfs.ImportSource(ctx, dserv, "small", bytes.NewReader(content[:100]), "size-4096", 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{100}, small.LeafSizes)
+
+	_, err = ipfs.ImportSource(ctx, dserv, "bad", bytes.NewReader(content), "nope", 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestAddSource_Quota(t *testing.T) {
+	ctx := context.Background()
+	content := make([]byte, 32*1024)
+	rand.New(rand.NewSource(7)).Read(content)
+
+	inst := offlineInstance(t)
+	inst.SetStorageSize(16 * 1024)
+
+	_, err := inst.AddSource(ctx, "big", bytes.NewReader(content))
+	assert.ErrorIs(t, err, ipfs.ErrOverQuota)
+	_, err = inst.SourceByName("big")
+	assert.ErrorIs(t, err, ipfs.ErrSourceNotFound)
+
+	_, err = inst.AddSource(ctx, "small", bytes.NewReader(content[:8*1024]))
+	assert.Nil(t, err)
+	// The first one is still taking up most of the room
+	_, err = inst.AddSource(ctx, "small2", bytes.NewReader(content[8*1024:20*1024]))
+	assert.ErrorIs(t, err, ipfs.ErrOverQuota)
+}
+
+// A registry that turns down every source while refuse is set
+type refusingRegistry struct {
+	registry.Registry
+	refuse bool
+}
+
+func (r *refusingRegistry) Add(ctx context.Context, source model.Source) error {
+	if r.refuse {
+		return errors.New("registry is down")
+	}
+	return r.Registry.Add(ctx, source)
+}
+
+func TestAddSource_RegistryFails(t *testing.T) {
+	ctx := context.Background()
+	inst := offlineInstance(t)
+	reg := &refusingRegistry{Registry: registry.NewFileRegistry(filepath.Join(t.TempDir(), "sources.json")), refuse: true}
+	inst.Registry = reg
+
+	// Nothing is kept locally when the registry says no, so trying again works
+	_, err := inst.AddSource(ctx, "data", bytes.NewReader([]byte("hello")))
+	assert.NotNil(t, err)
+	_, err = inst.SourceByName("data")
+	assert.ErrorIs(t, err, ipfs.ErrSourceNotFound)
+
+	reg.refuse = false
+	_, err = inst.AddSource(ctx, "data", bytes.NewReader([]byte("hello")))
+	assert.Nil(t, err)
+}
+
+func TestAddSource_NotStarted(t *testing.T) {
+	t.Setenv("XNODE_IP", "127.0.0.1")
+	conf := ipfs.DefaultConfig()
+	conf.Datastore = ipfs.DATASTORE_MEMORY
+	inst := ipfs.NewInstance(conf)
+	t.Cleanup(func() { inst.Host.Close() })
+
+	_, err := inst.AddSource(context.Background(), "data", bytes.NewReader([]byte("hello")))
+	assert.NotNil(t, err)
+}
+
+// Runs a collection once half the data has been read
+type collectingReader struct {
+	r    io.Reader
+	read int
+	gc   func()
+}
+
+func (c *collectingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.read < 16*4096 && c.read+n >= 16*4096 {
+		c.gc()
+	}
+	c.read += n
+	return n, err
+}
+
+func TestAddSource_CollectedWhileWriting(t *testing.T) {
+	ctx := context.Background()
+	inst := offlineInstance(t)
+
+	content := make([]byte, 32*4096)
+	rand.New(rand.NewSource(1)).Read(content)
+	r := &collectingReader{r: bytes.NewReader(content), gc: func() {
+		_, err := inst.CollectGarbage(ctx, ipfs.GC_MANUAL)
+		assert.Nil(t, err)
+	}}
+
+	// The GC doesn't wait for the upload and doesn't take what it wrote so far
+	source, err := inst.AddSource(ctx, "data", r)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, inst.LastGC().Removed)
+
+	reader, err := inst.OpenCid(ctx, cid.MustParse(source.Cid))
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, content, data)
+}
@@ -0,0 +1,158 @@
+package ipfs
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// StorageReport is what this node is storing, in bytes actually sitting in the blockstore
+type StorageReport struct {
+	Quota    int64
+	Used     int64
+	Free     int64
+	Overhead int64 // Everything that isn't an allocated leaf
+	Leaves   int64 // Leaves we were allocated
+	Metadata int64 // Intermediate DAG nodes of known sources
+	Cache    int64 // Everything else, leaves we don't want anymore, blocks fetched for retrieval...
+	Blocks   int
+}
+
+// accountant is a blockstore that keeps track of the size of every block it holds
+type accountant struct {
+	blockstore.Blockstore
+	mutex sync.Mutex
+	sizes map[string]int64 // By multihash, the blockstore doesn't keep the codec
+}
+
+// Wraps bs, counting the blocks that are already in it
+func newAccountant(ctx context.Context, bs blockstore.Blockstore) *accountant {
+	a := &accountant{Blockstore: bs, sizes: make(map[string]int64)}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		log.Println("Couldn't list the blockstore, storage starts out uncounted:", err)
+		return a
+	}
+	for c := range keys {
+		if size, err := bs.GetSize(ctx, c); err == nil {
+			a.sizes[string(c.Hash())] = int64(size)
+		}
+	}
+
+	return a
+}
+
+func (a *accountant) Put(ctx context.Context, b blocks.Block) error {
+	if err := a.Blockstore.Put(ctx, b); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.sizes[string(b.Cid().Hash())] = int64(len(b.RawData()))
+	a.mutex.Unlock()
+	return nil
+}
+
+func (a *accountant) PutMany(ctx context.Context, bs []blocks.Block) error {
+	if err := a.Blockstore.PutMany(ctx, bs); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	for _, b := range bs {
+		a.sizes[string(b.Cid().Hash())] = int64(len(b.RawData()))
+	}
+	a.mutex.Unlock()
+	return nil
+}
+
+func (a *accountant) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	if err := a.Blockstore.DeleteBlock(ctx, c); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	delete(a.sizes, string(c.Hash()))
+	a.mutex.Unlock()
+	return nil
+}
+
+// Copy of the sizes, by multihash
+func (a *accountant) snapshot() map[string]int64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	sizes := make(map[string]int64, len(a.sizes))
+	for k, v := range a.sizes {
+		sizes[k] = v
+	}
+	return sizes
+}
+
+// StorageReport splits the bytes in the blockstore into allocated leaves, metadata and cache
+func (inst *Instance) StorageReport() StorageReport {
+	report := StorageReport{Quota: int64(inst.StorageSize())}
+	if inst.accountant == nil {
+		return report
+	}
+
+	allocated := make(map[string]bool)
+	metadata := make(map[string]bool)
+
+	inst.BlockMapsMutex.Lock()
+	for name, layout := range inst.layouts {
+		for _, c := range layout.Nodes {
+			metadata[string(c.Hash())] = true
+		}
+		for _, i := range inst.BlocksToSeed[name] {
+			if i < len(layout.Leaves) {
+				allocated[string(layout.Leaves[i].Hash())] = true
+			}
+		}
+	}
+	inst.BlockMapsMutex.Unlock()
+
+	for h, size := range inst.accountant.snapshot() {
+		report.Used += size
+		report.Blocks++
+
+		switch {
+		case allocated[h]:
+			report.Leaves += size
+		case metadata[h]:
+			report.Metadata += size
+		default:
+			report.Cache += size
+		}
+	}
+
+	report.Overhead = report.Used - report.Leaves
+	report.Free = report.Quota - report.Used
+	if report.Free < 0 {
+		report.Free = 0
+	}
+
+	return report
+}
+
+// LeafSize is the size of leaf i of a source, parity leaves included
+func (inst *Instance) LeafSize(source Source, i int) (int64, error) {
+	return inst.leafSize(source, i)
+}
+
+// The size of a leaf as the DAG has it, falls back on the source's leaf table before the DAG is walked
+func (inst *Instance) leafSize(source Source, i int) (int64, error) {
+	inst.BlockMapsMutex.Lock()
+	layout, ok := inst.layouts[source.Name]
+	inst.BlockMapsMutex.Unlock()
+
+	if ok && i < len(layout.LeafSizes) && layout.LeafSizes[i] >= 0 {
+		return layout.LeafSizes[i], nil
+	}
+	return source.BlockSize(i)
+}
@@ -0,0 +1,286 @@
+package ipfs
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+const (
+	syncWorkers         = 16
+	syncFetchTimeout    = 30 * time.Second
+	syncRetryInterval   = 5 * time.Second
+	syncThroughputSpan  = 10 * time.Second
+	syncReallocateCheck = 64 // Fetches between checks for a new allocation
+)
+
+// SyncStats is what the sync engine has been up to
+type SyncStats struct {
+	QueueDepth     int // Wanted blocks we don't hold yet
+	InFlight       int
+	Fetched        uint64
+	FetchedBytes   uint64
+	Failed         uint64
+	Evicted        uint64
+	BytesPerSecond float64 // Over the last few seconds
+	LastPass       time.Time
+}
+
+type syncSample struct {
+	at    time.Time
+	bytes int
+}
+
+// syncEngine moves the blockstore towards BlocksToSeed, one diff at a time
+type syncEngine struct {
+	wake    chan struct{}
+	mutex   sync.Mutex
+	stats   SyncStats
+	samples []syncSample
+}
+
+func newSyncEngine() syncEngine {
+	return syncEngine{wake: make(chan struct{}, 1)}
+}
+
+// Wakes the sync loop up, never blocks
+func (e *syncEngine) poke() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *syncEngine) update(f func(s *SyncStats)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	f(&e.stats)
+}
+
+func (e *syncEngine) fetched(bytes int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.stats.Fetched++
+	e.stats.FetchedBytes += uint64(bytes)
+	e.samples = append(e.samples, syncSample{at: time.Now(), bytes: bytes})
+}
+
+// SyncStats returns a snapshot of the sync engine's queue and throughput
+func (inst *Instance) SyncStats() SyncStats {
+	e := &inst.syncer
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	cutoff := time.Now().Add(-syncThroughputSpan)
+	i := 0
+	for i < len(e.samples) && e.samples[i].at.Before(cutoff) {
+		i++
+	}
+	e.samples = e.samples[i:]
+
+	total := 0
+	for _, s := range e.samples {
+		total += s.bytes
+	}
+
+	stats := e.stats
+	stats.BytesPerSecond = float64(total) / syncThroughputSpan.Seconds()
+	return stats
+}
+
+// SetStorageSize changes how much this node is willing to store and works out the wanted blocks again
+func (inst *Instance) SetStorageSize(size int) {
+	inst.storageMutex.Lock()
+	inst.storageSize = size
+	inst.storageMutex.Unlock()
+
+	inst.reallocate()
+}
+
+// StorageSize is how many bytes this node is willing to store
+func (inst *Instance) StorageSize() int {
+	inst.storageMutex.Lock()
+	defer inst.storageMutex.Unlock()
+
+	return inst.storageSize
+}
+
+type syncFetch struct {
+	source string
+	index  int
+	leaf   cid.Cid
+}
+
+// Keeps the blockstore in line with the allocation.
+// Sleeps until something changes (resize, registry, cluster), or until it's time to retry failed fetches.
+func (inst *Instance) runSync(ctx context.Context, ng format.NodeGetter) {
+	prevSize := inst.StorageSize()
+
+	for {
+		if size := inst.StorageSize(); inst.takeReallocation() || prevSize != size {
+			inst.collectCache(ctx)
+			inst.allocateBlocks()
+			prevSize = size
+		}
+
+		var retry <-chan time.Time
+		if remaining := inst.syncOnce(ctx, ng); remaining > 0 {
+			retry = time.After(syncRetryInterval)
+		}
+
+		select {
+		case <-inst.syncer.wake:
+		case <-retry:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// One pass of the sync engine: unpins held blocks that aren't wanted, fetches wanted blocks that aren't held.
+// Unpinned blocks stay in the blockstore until the GC gets to them, straight away if we're over the storage size.
+// BlockMapsMutex is only held to read the diff and to record results, never during a download.
+// Returns how many wanted blocks are still missing.
+func (inst *Instance) syncOnce(ctx context.Context, ng format.NodeGetter) int {
+	fetches := make([]syncFetch, 0)
+	released := 0
+
+	inst.BlockMapsMutex.Lock()
+	// Wanted leaves are pinned before they're fetched so the GC never takes them
+	inst.pinAllocatedLocked()
+
+	for name, leaves := range inst.LeafBlocks {
+		wanted := make(map[int]bool)
+		for _, i := range inst.BlocksToSeed[name] {
+			wanted[i] = true
+		}
+
+		held := make([]int, 0, len(inst.BlocksSeeding[name]))
+		heldSet := make(map[int]bool)
+		for _, i := range inst.BlocksSeeding[name] {
+			if wanted[i] {
+				held = append(held, i)
+				heldSet[i] = true
+			} else {
+				released++
+			}
+		}
+		sort.Ints(held)
+		inst.BlocksSeeding[name] = held
+
+		for i := range wanted {
+			if !heldSet[i] && i < len(leaves) && leaves[i].Defined() {
+				fetches = append(fetches, syncFetch{source: name, index: i, leaf: leaves[i]})
+			}
+		}
+	}
+	inst.BlockMapsMutex.Unlock()
+
+	inst.collectIfOverQuota(ctx)
+
+	sort.Slice(fetches, func(i, j int) bool {
+		if fetches[i].source != fetches[j].source {
+			return fetches[i].source < fetches[j].source
+		}
+		return fetches[i].index < fetches[j].index
+	})
+
+	inst.syncer.update(func(s *SyncStats) {
+		s.QueueDepth = len(fetches)
+		s.LastPass = time.Now()
+	})
+
+	if len(fetches) == 0 {
+		inst.Status = SEEDING_BLOCKS
+		return 0
+	}
+
+	inst.Status = DOWNLOADING_BLOCKS
+	log.Println("Syncing", len(fetches), "missing blocks, released", released)
+
+	leaves := make([]string, len(fetches))
+	for i, f := range fetches {
+		leaves[i] = f.leaf.String()
+	}
+	inst.preferReputable(ctx, leaves)
+
+	remaining := len(fetches)
+	var remainingMutex sync.Mutex
+
+	jobs := make(chan syncFetch)
+	var wg sync.WaitGroup
+	for w := 0; w < syncWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				inst.syncer.update(func(s *SyncStats) { s.InFlight++ })
+
+				fctx, cancel := context.WithTimeout(ctx, syncFetchTimeout)
+				node, err := ng.Get(fctx, f.leaf)
+				cancel()
+
+				inst.syncer.update(func(s *SyncStats) {
+					s.InFlight--
+					s.QueueDepth--
+				})
+
+				if err != nil {
+					inst.syncer.update(func(s *SyncStats) { s.Failed++ })
+					if ctx.Err() == nil {
+						inst.fetchFailed(f.leaf.String(), err)
+					}
+					continue
+				}
+				inst.syncer.fetched(len(node.RawData()))
+
+				inst.BlockMapsMutex.Lock()
+				if _, ok := inst.LeafBlocks[f.source]; ok {
+					inst.BlocksSeeding[f.source] = insertIndex(inst.BlocksSeeding[f.source], f.index)
+				}
+				inst.BlockMapsMutex.Unlock()
+
+				remainingMutex.Lock()
+				remaining--
+				remainingMutex.Unlock()
+			}
+		}()
+	}
+
+	for n, f := range fetches {
+		if ctx.Err() != nil {
+			break
+		}
+		// Don't keep downloading blocks that might not be wanted anymore
+		if n > 0 && n%syncReallocateCheck == 0 && inst.reallocationPending() {
+			break
+		}
+		jobs <- f
+	}
+	close(jobs)
+	wg.Wait()
+
+	inst.syncer.update(func(s *SyncStats) { s.QueueDepth = remaining })
+	if remaining == 0 {
+		inst.Status = SEEDING_BLOCKS
+	}
+	return remaining
+}
+
+// Adds i to a sorted list of indices if it isn't there yet
+func insertIndex(indices []int, i int) []int {
+	at := sort.SearchInts(indices, i)
+	if at < len(indices) && indices[at] == i {
+		return indices
+	}
+	indices = append(indices, 0)
+	copy(indices[at+1:], indices[at:])
+	indices[at] = i
+	return indices
+}
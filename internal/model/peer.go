@@ -2,8 +2,21 @@ package model
 
 // Peer is a single Xnode instance
 type Peer struct {
-    Name       string
-    Hostname   string
-    GossipPort int
-    Alive      bool
+	Name       string
+	Hostname   string
+	GossipPort int
+	Alive      bool
+}
+
+const (
+	MEMBER_JOINED = "joined"
+	MEMBER_LEFT   = "left"   // Drained and said goodbye
+	MEMBER_FAILED = "failed" // Stopped answering, or left without draining
+)
+
+// MemberEvent is a node joining or leaving the cluster
+type MemberEvent struct {
+	Type  string    // One of the MEMBER_ constants
+	Name  string    // Gossip name of the node
+	State NodeState // The last state we had from the node, empty if we never got one
 }
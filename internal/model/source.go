@@ -0,0 +1,121 @@
+package model
+
+import (
+	"errors"
+	"slices"
+)
+
+// DefaultBlockSize is the size of the chunks sources are split into
+const DefaultBlockSize = 128 * 1024
+
+// DefaultChunker splits sources into DefaultBlockSize chunks, written the way boxo's chunker.FromString reads it
+const DefaultChunker = "size-131072"
+
+// Source is a single dataset shared across the cluster
+type Source struct {
+	Name      string
+	Size      int64
+	Cid       string   // an id to the ROOT
+	Chunker   string   `json:",omitempty"` // How the data was split into leaves, like size-131072, rabin-min-avg-max or buzhash
+	LeafSizes []int64  `json:",omitempty"` // The size of every data leaf in order, as the DAG has them
+	Erasure   *Erasure `json:",omitempty"` // How the leaves are erasure coded, nil if they aren't
+}
+
+// Same returns true if both sources have the same data laid out the same way
+func (s *Source) Same(other Source) bool {
+	if s.Name != other.Name || s.Size != other.Size || s.Cid != other.Cid || s.Chunker != other.Chunker || !slices.Equal(s.LeafSizes, other.LeafSizes) {
+		return false
+	}
+	if s.Erasure == nil || other.Erasure == nil {
+		return s.Erasure == other.Erasure
+	}
+	return *s.Erasure == *other.Erasure
+}
+
+// Erasure is how the leaves of a source are erasure coded.
+// The data leaves are grouped into stripes of Data leaves, every stripe gets Parity parity leaves,
+// and any Data members of a stripe are enough to get the others back.
+type Erasure struct {
+	Data      int
+	Parity    int
+	ShardSize int64  // Every member of a stripe is padded to this size
+	Cid       string // Root of the DAG holding the parity leaves, one stripe after the other
+}
+
+// Stripes is how many stripes it takes to cover the data leaves
+func (e *Erasure) Stripes(dataLeaves int) int {
+	return (dataLeaves + e.Data - 1) / e.Data
+}
+
+// ParityLeaves is how many parity leaves there are in total
+func (e *Erasure) ParityLeaves(dataLeaves int) int {
+	return e.Stripes(dataLeaves) * e.Parity
+}
+
+// Stripe returns the stripe leaf i is in, counting the data leaves first and then the parity leaves
+func (e *Erasure) Stripe(i int, dataLeaves int) int {
+	if i < dataLeaves {
+		return i / e.Data
+	}
+	return (i - dataLeaves) / e.Parity
+}
+
+// Members returns the index of every member of a stripe, data then parity.
+// The last stripe can run out of data leaves, those count as zeroes and come back as -1.
+func (e *Erasure) Members(stripe int, dataLeaves int) []int {
+	members := make([]int, e.Data+e.Parity)
+	for d := 0; d < e.Data; d++ {
+		members[d] = stripe*e.Data + d
+		if members[d] >= dataLeaves {
+			members[d] = -1
+		}
+	}
+	for p := 0; p < e.Parity; p++ {
+		members[e.Data+p] = dataLeaves + stripe*e.Parity + p
+	}
+	return members
+}
+
+// BlocksInSize is how many DefaultBlockSize chunks it takes to fit size bytes
+func BlocksInSize(size int64) int64 {
+	blockCount := int64(size) / (DefaultBlockSize)
+	// blocks HAVE to fit the data so if they don't divide nicelly, we need an extra chunk to fit the data
+	if size < DefaultBlockSize && size > 0 {
+		blockCount = 1
+	} else if size%int64(DefaultBlockSize) != 0 && size > int64(DefaultBlockSize) {
+		blockCount += 1
+	}
+
+	return blockCount
+}
+
+// BlockCount is how many data leaves the source has.
+// Sources published without a leaf size table are assumed to be split into DefaultBlockSize chunks.
+func (s *Source) BlockCount() int64 {
+	if len(s.LeafSizes) > 0 {
+		return int64(len(s.LeafSizes))
+	}
+	return BlocksInSize(s.Size)
+}
+
+// BlockSize is the size of data leaf index, from the leaf size table if there is one
+func (s *Source) BlockSize(index int) (int64, error) {
+	if len(s.LeafSizes) > 0 {
+		if index < 0 || index >= len(s.LeafSizes) {
+			return 0, errors.New("Index out of range")
+		}
+		return s.LeafSizes[index], nil
+	}
+
+	blocksCount := BlocksInSize(s.Size)
+	if int64(index) > blocksCount-1 {
+		return 0, errors.New("Index out of range")
+	} else {
+		if index == int(blocksCount)-1 {
+			// size is remainder
+			return (s.Size) - ((blocksCount - 1) * (DefaultBlockSize)), nil
+		} else {
+			return DefaultBlockSize, nil
+		}
+	}
+}
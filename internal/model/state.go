@@ -0,0 +1,61 @@
+package model
+
+// Bitmap is a compact set of block indices, bit i is set when block i is held
+type Bitmap []byte
+
+// NewBitmap creates a bitmap big enough to hold n blocks
+func NewBitmap(n int) Bitmap {
+	return make(Bitmap, (n+7)/8)
+}
+
+// Set marks block i as held, growing the bitmap if needed
+func (b *Bitmap) Set(i int) {
+	for len(*b) <= i/8 {
+		*b = append(*b, 0)
+	}
+	(*b)[i/8] |= 1 << (i % 8)
+}
+
+// Has returns true if block i is held
+func (b Bitmap) Has(i int) bool {
+	if i < 0 || i/8 >= len(b) {
+		return false
+	}
+	return b[i/8]&(1<<(i%8)) != 0
+}
+
+// Indices returns every block index that is held, in order
+func (b Bitmap) Indices() []int {
+	indices := make([]int, 0)
+	for i := 0; i < len(b)*8; i++ {
+		if b.Has(i) {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// Count returns how many blocks are held
+func (b Bitmap) Count() int {
+	count := 0
+	for _, by := range b {
+		for ; by != 0; by &= by - 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// NodeState is what every node shares about itself with the rest of the cluster
+type NodeState struct {
+	Name     string
+	PeerID   string            // libp2p peer id of the node's ipfs host
+	Role     string            // What the node does in the cluster, see the ipfs ROLE_ constants
+	Capacity int64             // Storage the node offers to the cluster in bytes
+	Version  int64             // The newest version wins when merging
+	Holdings map[string]Bitmap // Blocks being seeded, by source root cid
+	Sources  []Source          // Sources shared by the gossip registry
+	Removed  []string          // Names of sources removed from the gossip registry
+	Hot      []string          `json:",omitempty"` // Leaves the node gets a lot of requests for, by cid
+	Draining bool              `json:",omitempty"` // The node is handing off its blocks before it leaves
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-kad-dht"
+	record "github.com/libp2p/go-libp2p-record"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -23,6 +24,7 @@ type Instance struct {
 	Host       *host.Host
 	DHT        *dht.IpfsDHT
 	PeerNotify *PeerNotify
+	Sources    *SourceValidator // Checks the signed source records in the DHT
 	StartMdns  func() error
 	CloseMdns  func() error
 }
@@ -69,11 +71,21 @@ func NewLibP2PInstance(p2pPort int, groupName string, h *host.Host) *Instance {
 
 	// Create the DHT client using the host
 	p2pDHT, err := dht.New(context.Background(), *p2pHost, dht.Mode(dht.ModeAutoServer))
-	p2pDHT.Validator = &Validator{}
 	if err != nil {
 		log.Fatalf("Failed to create Kademlia DHT: %s", err.Error())
 	}
 
+	// The /ipfs protocol won't take extra namespaces through the options, so add ours next to /pk and /ipns after the fact
+	sources := &SourceValidator{}
+	lists := &SourceListValidator{Sources: sources}
+	if nsval, ok := p2pDHT.Validator.(record.NamespacedValidator); ok {
+		nsval["xnode"] = &Validator{}
+		nsval[SOURCE_NAMESPACE] = sources
+		nsval[SOURCE_LIST_NAMESPACE] = lists
+	} else {
+		p2pDHT.Validator = record.NamespacedValidator{"xnode": &Validator{}, SOURCE_NAMESPACE: sources, SOURCE_LIST_NAMESPACE: lists}
+	}
+
 	log.Printf("Successfully initialised a host with ID %s", (*p2pHost).ID())
 
 	// Since mdns.NewMdnsService returns an unexported struct, we need to manually export some
@@ -83,6 +95,7 @@ func NewLibP2PInstance(p2pPort int, groupName string, h *host.Host) *Instance {
 		DHT:        p2pDHT,
 		GroupName:  groupName,
 		PeerNotify: n,
+		Sources:    sources,
 		StartMdns:  mdnsSrv.Start,
 		CloseMdns:  mdnsSrv.Close,
 	}
@@ -9,14 +9,14 @@ import (
 )
 
 func TestNewLibP2PInstance(t *testing.T) {
-    instance := p2p.NewLibP2PInstance(10090, "Xnode-test")
+    instance := p2p.NewLibP2PInstance(10090, "Xnode-test", nil)
     assert.NotNil(t, instance)
     t.Logf("%#v", instance)
     instance.Stop()
 }
 
 func TestInstance_Start(t *testing.T) {
-    instance := p2p.NewLibP2PInstance(10090, "Xnode-test")
+    instance := p2p.NewLibP2PInstance(10090, "Xnode-test", nil)
     assert.NotNil(t, instance)
     err := instance.Start(context.Background())
     assert.Nil(t, err)
@@ -27,8 +27,8 @@ func TestInstance_Start(t *testing.T) {
 func TestDHT(t *testing.T) {
     // Initialise two peers within the same group
     gn := "Xnode-test"
-    i1 := p2p.NewLibP2PInstance(10090, gn)
-    i2 := p2p.NewLibP2PInstance(10091, gn)
+    i1 := p2p.NewLibP2PInstance(10090, gn, nil)
+    i2 := p2p.NewLibP2PInstance(10091, gn, nil)
 
     // Start peers
     err := i1.Start(context.Background())
@@ -53,3 +53,41 @@ func TestDHT(t *testing.T) {
     err = i2.Stop()
     assert.Nil(t, err)
 }
+
+func TestDHT_SourceRecords(t *testing.T) {
+    gn := "Xnode-test"
+    i1 := p2p.NewLibP2PInstance(10090, gn, nil)
+    i2 := p2p.NewLibP2PInstance(10091, gn, nil)
+
+    err := i1.Start(context.Background())
+    assert.Nil(t, err)
+    err = i2.Start(context.Background())
+    assert.Nil(t, err)
+
+    time.Sleep(5 * time.Second)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    id := (*i1.Host).ID()
+    key := p2p.SourceKey(id, "a.csv")
+
+    // Unsigned values are turned away
+    err = i1.DHT.PutValue(ctx, key, []byte("20"))
+    assert.NotNil(t, err)
+
+    sk := (*i1.Host).Peerstore().PrivKey(id)
+    err = i1.DHT.PutValue(ctx, key, signedRecord(t, sk, "a.csv", 1))
+    assert.Nil(t, err)
+    res, err := i2.DHT.GetValue(ctx, key)
+    assert.Nil(t, err)
+    rec, err := p2p.ParseSourceRecord(res)
+    assert.Nil(t, err)
+    assert.Equal(t, "a.csv", rec.Source.Name)
+
+    // Cleanup
+    err = i1.Stop()
+    assert.Nil(t, err)
+    err = i2.Stop()
+    assert.Nil(t, err)
+}
@@ -1,16 +1,325 @@
 package p2p
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+// SOURCE_NAMESPACE is the DHT namespace signed source records live under, keys look like /xnode-source/<peer id>/<name>.
+// A publisher can only write records under its own peer id so nobody else can take over its sources.
+const SOURCE_NAMESPACE = "xnode-source"
+
+// SOURCE_LIST_NAMESPACE is where every publisher keeps the signed list of its sources, keys look like /xnode-sources/<peer id>
+const SOURCE_LIST_NAMESPACE = "xnode-sources"
+
 // Validator is a validator that always returns valid
 type Validator struct {
 }
 
 // Validate is to determine whether a key is valid
 func (v *Validator) Validate(key string, value []byte) error {
-    // nil = valid
-    return nil
+	// nil = valid
+	return nil
 }
 
 // Select returns the index of the best value and nil, or -1 and an error if none are valid
 func (v *Validator) Select(key string, values [][]byte) (int, error) {
-    return 0, nil
+	return 0, nil
+}
+
+// SourceKey returns the DHT key of the record publisher keeps for a source
+func SourceKey(publisher peer.ID, name string) string {
+	return "/" + SOURCE_NAMESPACE + "/" + publisher.String() + "/" + name
+}
+
+// SourceListKey returns the DHT key of a publisher's list of sources
+func SourceListKey(publisher peer.ID) string {
+	return "/" + SOURCE_LIST_NAMESPACE + "/" + publisher.String()
+}
+
+// SourceRecord is a source manifest signed by whoever published it.
+// A higher Seq replaces a lower one, a Removed record is a tombstone.
+type SourceRecord struct {
+	Source    model.Source
+	Seq       uint64
+	Removed   bool
+	PublicKey []byte // Marshalled libp2p public key of the publisher
+	Signature []byte
+}
+
+// The bytes that get signed, everything but the signature itself
+func (r *SourceRecord) signedBytes() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	b, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(SOURCE_NAMESPACE+":"), b...), nil
+}
+
+// Sign fills in the public key and signature with the publisher's key
+func (r *SourceRecord) Sign(sk crypto.PrivKey) error {
+	pk, err := crypto.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return err
+	}
+	r.PublicKey = pk
+
+	data, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	r.Signature, err = sk.Sign(data)
+	return err
+}
+
+// Publisher returns the peer id of the key that signed the record
+func (r *SourceRecord) Publisher() (peer.ID, error) {
+	return publisherOf(r.PublicKey)
+}
+
+// Verify checks the record is well formed and the signature matches its contents
+func (r *SourceRecord) Verify() error {
+	if r.Source.Name == "" {
+		return errors.New("source record has no name")
+	}
+	if _, err := cid.Parse(r.Source.Cid); err != nil {
+		return fmt.Errorf("source record has a bad root cid: %w", err)
+	}
+
+	data, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	if err := checkSignature(r.PublicKey, data, r.Signature); err != nil {
+		return fmt.Errorf("source record %w", err)
+	}
+	return nil
+}
+
+func publisherOf(publicKey []byte) (peer.ID, error) {
+	pk, err := crypto.UnmarshalPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPublicKey(pk)
+}
+
+func checkSignature(publicKey []byte, data []byte, signature []byte) error {
+	pk, err := crypto.UnmarshalPublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("has a bad public key: %w", err)
+	}
+	if ok, err := pk.Verify(data, signature); err != nil || !ok {
+		return errors.New("signature doesn't match")
+	}
+	return nil
+}
+
+// ParseSourceRecord decodes a record and checks its signature
+func ParseSourceRecord(value []byte) (*SourceRecord, error) {
+	var r SourceRecord
+	if err := json.Unmarshal(value, &r); err != nil {
+		return nil, err
+	}
+	if err := r.Verify(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Splits the part of a key after the namespace into the publisher and what's left, the source name for records
+func splitPublisher(key string, namespace string) (peer.ID, string, error) {
+	ns, rest, err := record.SplitKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if ns != namespace {
+		return "", "", fmt.Errorf("key %s is not in the %s namespace", key, namespace)
+	}
+
+	id, name, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	publisher, err := peer.Decode(id)
+	if err != nil {
+		return "", "", fmt.Errorf("key %s has a bad publisher: %w", key, err)
+	}
+	return publisher, name, nil
+}
+
+// SourceValidator only lets signed source records into the DHT, signed by the publisher in their key.
+// If Publishers is set, records have to be signed by one of those peers.
+type SourceValidator struct {
+	Publishers map[peer.ID]bool
+}
+
+// Checks whoever signed something stored under publisher's key is publisher, and one we accept
+func (v *SourceValidator) checkPublisher(publisher peer.ID, signer peer.ID) error {
+	if signer != publisher {
+		return fmt.Errorf("signed by %s, stored under %s", signer, publisher)
+	}
+	if len(v.Publishers) > 0 && !v.Publishers[signer] {
+		return fmt.Errorf("published by unknown peer %s", signer)
+	}
+	return nil
+}
+
+// Validate rejects records that are tampered with, stored under the wrong name or publisher, or signed by an unknown publisher
+func (v *SourceValidator) Validate(key string, value []byte) error {
+	publisher, name, err := splitPublisher(key, SOURCE_NAMESPACE)
+	if err != nil {
+		return err
+	}
+
+	r, err := ParseSourceRecord(value)
+	if err != nil {
+		return err
+	}
+	if r.Source.Name != name {
+		return fmt.Errorf("record for source %s stored under %s", r.Source.Name, key)
+	}
+
+	signer, err := r.Publisher()
+	if err != nil {
+		return err
+	}
+	if err := v.checkPublisher(publisher, signer); err != nil {
+		return fmt.Errorf("source %s %w", name, err)
+	}
+	return nil
+}
+
+// Select picks the valid record with the highest sequence number, the first one wins a tie
+func (v *SourceValidator) Select(key string, values [][]byte) (int, error) {
+	best := -1
+	var bestSeq uint64
+	for i, value := range values {
+		if v.Validate(key, value) != nil {
+			continue
+		}
+
+		r, _ := ParseSourceRecord(value)
+		if best == -1 || r.Seq > bestSeq {
+			best = i
+			bestSeq = r.Seq
+		}
+	}
+
+	if best == -1 {
+		return -1, errors.New("no valid source record")
+	}
+	return best, nil
+}
+
+// SourceList is the names of the sources a publisher has records for, signed like a SourceRecord.
+// A higher Seq replaces a lower one.
+type SourceList struct {
+	Names     []string
+	Seq       uint64
+	PublicKey []byte
+	Signature []byte
+}
+
+func (l *SourceList) signedBytes() ([]byte, error) {
+	unsigned := *l
+	unsigned.Signature = nil
+	b, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(SOURCE_LIST_NAMESPACE+":"), b...), nil
+}
+
+// Sign fills in the public key and signature with the publisher's key
+func (l *SourceList) Sign(sk crypto.PrivKey) error {
+	pk, err := crypto.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return err
+	}
+	l.PublicKey = pk
+
+	data, err := l.signedBytes()
+	if err != nil {
+		return err
+	}
+	l.Signature, err = sk.Sign(data)
+	return err
+}
+
+// Publisher returns the peer id of the key that signed the list
+func (l *SourceList) Publisher() (peer.ID, error) {
+	return publisherOf(l.PublicKey)
+}
+
+// ParseSourceList decodes a list and checks its signature
+func ParseSourceList(value []byte) (*SourceList, error) {
+	var l SourceList
+	if err := json.Unmarshal(value, &l); err != nil {
+		return nil, err
+	}
+
+	data, err := l.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignature(l.PublicKey, data, l.Signature); err != nil {
+		return nil, fmt.Errorf("source list %w", err)
+	}
+	return &l, nil
+}
+
+// SourceListValidator only lets publishers write their own signed list of sources into the DHT
+type SourceListValidator struct {
+	Sources *SourceValidator // Goes by the same publishers
+}
+
+// Validate rejects lists that are tampered with or signed by anyone but the publisher in the key
+func (v *SourceListValidator) Validate(key string, value []byte) error {
+	publisher, _, err := splitPublisher(key, SOURCE_LIST_NAMESPACE)
+	if err != nil {
+		return err
+	}
+
+	l, err := ParseSourceList(value)
+	if err != nil {
+		return err
+	}
+	signer, err := l.Publisher()
+	if err != nil {
+		return err
+	}
+	if err := v.Sources.checkPublisher(publisher, signer); err != nil {
+		return fmt.Errorf("source list %w", err)
+	}
+	return nil
+}
+
+// Select picks the valid list with the highest sequence number, the first one wins a tie
+func (v *SourceListValidator) Select(key string, values [][]byte) (int, error) {
+	best := -1
+	var bestSeq uint64
+	for i, value := range values {
+		if v.Validate(key, value) != nil {
+			continue
+		}
+
+		l, _ := ParseSourceList(value)
+		if best == -1 || l.Seq > bestSeq {
+			best = i
+			bestSeq = l.Seq
+		}
+	}
+
+	if best == -1 {
+		return -1, errors.New("no valid source list")
+	}
+	return best, nil
 }
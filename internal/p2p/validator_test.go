@@ -0,0 +1,152 @@
+package p2p_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/model"
+	"openmesh.network/aggregationpoc/internal/p2p"
+)
+
+const testCid = "bafybeihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+
+func signedRecord(t *testing.T, sk crypto.PrivKey, name string, seq uint64) []byte {
+	rec := &p2p.SourceRecord{
+		Source: model.Source{Name: name, Size: 1024, Cid: testCid},
+		Seq:    seq,
+	}
+	assert.Nil(t, rec.Sign(sk))
+
+	b, err := json.Marshal(rec)
+	assert.Nil(t, err)
+	return b
+}
+
+func newKey(t *testing.T) crypto.PrivKey {
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	assert.Nil(t, err)
+	return sk
+}
+
+func TestSourceValidator_Validate(t *testing.T) {
+	v := &p2p.SourceValidator{}
+	sk := newKey(t)
+	id, err := peer.IDFromPrivateKey(sk)
+	assert.Nil(t, err)
+	value := signedRecord(t, sk, "a.csv", 1)
+
+	assert.Nil(t, v.Validate(p2p.SourceKey(id, "a.csv"), value))
+
+	// Stored under another name
+	assert.NotNil(t, v.Validate(p2p.SourceKey(id, "b.csv"), value))
+	// Wrong namespace
+	assert.NotNil(t, v.Validate("/xnode/a.csv", value))
+	// Not a record
+	assert.NotNil(t, v.Validate(p2p.SourceKey(id, "a.csv"), []byte("20")))
+
+	// Tampered with after signing
+	var rec p2p.SourceRecord
+	assert.Nil(t, json.Unmarshal(value, &rec))
+	rec.Seq = 5
+	tampered, _ := json.Marshal(rec)
+	assert.NotNil(t, v.Validate(p2p.SourceKey(id, "a.csv"), tampered))
+
+	rec.Seq = 1
+	rec.Source.Cid = "bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy"
+	tampered, _ = json.Marshal(rec)
+	assert.NotNil(t, v.Validate(p2p.SourceKey(id, "a.csv"), tampered))
+}
+
+func TestSourceValidator_Hijack(t *testing.T) {
+	v := &p2p.SourceValidator{}
+	owner := newKey(t)
+	id, err := peer.IDFromPrivateKey(owner)
+	assert.Nil(t, err)
+
+	// Someone else's record can't go under the owner's key, whatever its sequence number
+	hijack := signedRecord(t, newKey(t), "a.csv", 100)
+	assert.NotNil(t, v.Validate(p2p.SourceKey(id, "a.csv"), hijack))
+
+	i, err := v.Select(p2p.SourceKey(id, "a.csv"), [][]byte{signedRecord(t, owner, "a.csv", 1), hijack})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, i)
+}
+
+func TestSourceValidator_Publishers(t *testing.T) {
+	trusted := newKey(t)
+	stranger := newKey(t)
+	id, err := peer.IDFromPrivateKey(trusted)
+	assert.Nil(t, err)
+	strangerID, err := peer.IDFromPrivateKey(stranger)
+	assert.Nil(t, err)
+
+	v := &p2p.SourceValidator{Publishers: map[peer.ID]bool{id: true}}
+	assert.Nil(t, v.Validate(p2p.SourceKey(id, "a.csv"), signedRecord(t, trusted, "a.csv", 1)))
+	assert.NotNil(t, v.Validate(p2p.SourceKey(strangerID, "a.csv"), signedRecord(t, stranger, "a.csv", 1)))
+}
+
+func TestSourceValidator_Select(t *testing.T) {
+	v := &p2p.SourceValidator{}
+	sk := newKey(t)
+	id, err := peer.IDFromPrivateKey(sk)
+	assert.Nil(t, err)
+	key := p2p.SourceKey(id, "a.csv")
+
+	values := [][]byte{
+		signedRecord(t, sk, "a.csv", 1),
+		signedRecord(t, sk, "a.csv", 3),
+		[]byte("garbage"),
+		signedRecord(t, sk, "a.csv", 2),
+	}
+	i, err := v.Select(key, values)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, i)
+
+	// A forged record with a higher sequence number doesn't win
+	var forged p2p.SourceRecord
+	assert.Nil(t, json.Unmarshal(values[1], &forged))
+	forged.Seq = 10
+	b, _ := json.Marshal(forged)
+	i, err = v.Select(key, append(values, b))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, i)
+
+	_, err = v.Select(key, [][]byte{[]byte("garbage")})
+	assert.NotNil(t, err)
+}
+
+func signedList(t *testing.T, sk crypto.PrivKey, seq uint64, names ...string) []byte {
+	l := &p2p.SourceList{Names: names, Seq: seq}
+	assert.Nil(t, l.Sign(sk))
+
+	b, err := json.Marshal(l)
+	assert.Nil(t, err)
+	return b
+}
+
+func TestSourceListValidator(t *testing.T) {
+	v := &p2p.SourceListValidator{Sources: &p2p.SourceValidator{}}
+	sk := newKey(t)
+	id, err := peer.IDFromPrivateKey(sk)
+	assert.Nil(t, err)
+	key := p2p.SourceListKey(id)
+
+	assert.Nil(t, v.Validate(key, signedList(t, sk, 1, "a.csv")))
+	// Nobody else can empty the list
+	assert.NotNil(t, v.Validate(key, signedList(t, newKey(t), 2)))
+	assert.NotNil(t, v.Validate(key, []byte(`["a.csv"]`)))
+
+	var l p2p.SourceList
+	assert.Nil(t, json.Unmarshal(signedList(t, sk, 1, "a.csv"), &l))
+	l.Names = nil
+	tampered, _ := json.Marshal(l)
+	assert.NotNil(t, v.Validate(key, tampered))
+
+	i, err := v.Select(key, [][]byte{signedList(t, sk, 1, "a.csv"), signedList(t, sk, 2), tampered})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, i)
+}
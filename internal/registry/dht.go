@@ -0,0 +1,333 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	mh "github.com/multiformats/go-multihash"
+	"openmesh.network/aggregationpoc/internal/model"
+	"openmesh.network/aggregationpoc/internal/p2p"
+)
+
+// Provider records and DHT values expire after a day or two, ours are put out again well before that
+const dhtRepublishInterval = 12 * time.Hour
+
+// Publishers provide this so readers can find their lists
+var publishersCid, _ = cid.NewPrefixV1(cid.Raw, mh.SHA2_256).Sum([]byte(p2p.SOURCE_LIST_NAMESPACE))
+
+// DHTRegistry keeps every source as a record under /xnode-source/<peer id>/<name>, signed by the publisher.
+// Every publisher lists the names of its sources in a signed list under its own key, see p2p.SourceListKey,
+// and provides publishersCid so the lists can be found. Nobody can write to anyone else's records or list.
+// A name belongs to the first publisher we saw with it, as long as that publisher keeps it, so nobody can take a source over either.
+// Sources added through this node are republished every time the registry is polled,
+// so they make it in even if the DHT wasn't ready when they were added.
+type DHTRegistry struct {
+	DHT       *dht.IpfsDHT
+	Key       crypto.PrivKey // Signs the records of the sources we publish
+	self      peer.ID
+	added     []model.Source
+	removed   map[string]bool
+	mutex     sync.Mutex
+	syncMutex sync.Mutex         // One sync at a time, List and the poll both run one
+	owners    map[string]peer.ID // Who every name belongs to, only touched while syncing
+	listed    []string           // Our list as we last put it in the DHT
+	listedAt  time.Time
+}
+
+func NewDHTRegistry(d *dht.IpfsDHT, key crypto.PrivKey) *DHTRegistry {
+	self, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		log.Println("Couldn't work out the peer id of the registry key:", err)
+	}
+
+	return &DHTRegistry{
+		DHT:     d,
+		Key:     key,
+		self:    self,
+		added:   make([]model.Source, 0),
+		removed: make(map[string]bool),
+		owners:  make(map[string]peer.ID),
+	}
+}
+
+// Reads a publisher's list of names from the DHT, a missing list is empty
+func (r *DHTRegistry) getNames(ctx context.Context, publisher peer.ID) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	value, err := r.DHT.GetValue(ctx, p2p.SourceListKey(publisher))
+	if errors.Is(err, routing.ErrNotFound) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	l, err := p2p.ParseSourceList(value)
+	if err != nil {
+		return nil, err
+	}
+	if signer, err := l.Publisher(); err != nil || signer != publisher {
+		return nil, fmt.Errorf("source list of %s isn't signed by it", publisher)
+	}
+	return l.Names, nil
+}
+
+// Signs and puts our list of names in the DHT and provides publishersCid, only if it changed or it's time to republish
+func (r *DHTRegistry) putNames(ctx context.Context, names []string) error {
+	sort.Strings(names)
+	if len(names) == 0 && len(r.listed) == 0 {
+		// Not a publisher, nothing to list
+		return nil
+	}
+	if fmt.Sprint(names) == fmt.Sprint(r.listed) && time.Since(r.listedAt) < dhtRepublishInterval {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// The clock keeps going up across restarts, a counter wouldn't
+	l := &p2p.SourceList{Names: names, Seq: uint64(time.Now().UnixNano())}
+	if err := l.Sign(r.Key); err != nil {
+		return err
+	}
+	value, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := r.DHT.PutValue(ctx, p2p.SourceListKey(r.self), value); err != nil {
+		return err
+	}
+	if err := r.DHT.Provide(ctx, publishersCid, true); err != nil {
+		return err
+	}
+
+	r.listed = names
+	r.listedAt = time.Now()
+	return nil
+}
+
+// Every other node that provides publishersCid
+func (r *DHTRegistry) publishers(ctx context.Context) []peer.ID {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	found := make([]peer.ID, 0)
+	for info := range r.DHT.FindProvidersAsync(ctx, publishersCid, 0) {
+		if info.ID != r.self {
+			found = append(found, info.ID)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+	return found
+}
+
+// Reads the newest valid record a publisher has for a source, nil if there isn't one
+func (r *DHTRegistry) getRecord(ctx context.Context, publisher peer.ID, name string) (*p2p.SourceRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	value, err := r.DHT.GetValue(ctx, p2p.SourceKey(publisher, name))
+	if errors.Is(err, routing.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return p2p.ParseSourceRecord(value)
+}
+
+// Signs and publishes a record, it replaces whatever we published for the source before
+func (r *DHTRegistry) putRecord(ctx context.Context, source model.Source, removed bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Like the lists, the clock keeps going up without having to look up the last record
+	rec := &p2p.SourceRecord{Source: source, Seq: uint64(time.Now().UnixNano()), Removed: removed}
+	if err := rec.Sign(r.Key); err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return r.DHT.PutValue(ctx, p2p.SourceKey(r.self, source.Name), value)
+}
+
+// Publishes the records of our local changes that aren't in the DHT yet, returns the sources we own
+func (r *DHTRegistry) publish(ctx context.Context) []model.Source {
+	r.mutex.Lock()
+	added := append([]model.Source(nil), r.added...)
+	removed := make([]string, 0, len(r.removed))
+	for name := range r.removed {
+		removed = append(removed, name)
+	}
+	r.mutex.Unlock()
+
+	ours := make([]model.Source, 0, len(added))
+	for _, source := range added {
+		if owner, ok := r.owners[source.Name]; ok && owner != r.self {
+			log.Println("Source", source.Name, "is already published by", owner)
+			continue
+		}
+		r.owners[source.Name] = r.self
+		ours = append(ours, source)
+
+		current, err := r.getRecord(ctx, r.self, source.Name)
+		if err != nil {
+			log.Println("Couldn't look up source", source.Name, "in the DHT:", err)
+			continue
+		}
+		if current != nil && !current.Removed && current.Source.Same(source) {
+			continue
+		}
+
+		if err := r.putRecord(ctx, source, false); err != nil {
+			log.Println("Failed to publish source", source.Name, "to the DHT:", err)
+		}
+	}
+
+	for _, name := range removed {
+		if r.owners[name] == r.self {
+			delete(r.owners, name)
+		}
+
+		current, err := r.getRecord(ctx, r.self, name)
+		if err != nil {
+			log.Println("Couldn't look up source", name, "in the DHT:", err)
+			continue
+		}
+		if current == nil || current.Removed {
+			continue
+		}
+
+		if err := r.putRecord(ctx, current.Source, true); err != nil {
+			log.Println("Failed to remove source", name, "from the DHT:", err)
+		}
+	}
+
+	return ours
+}
+
+// sync reads every other publisher's list, publishes our local changes, then resolves every name into its owner's signed record.
+// Names without a record, or with a tombstone, are left out and free to be taken again.
+func (r *DHTRegistry) sync(ctx context.Context) ([]model.Source, error) {
+	r.syncMutex.Lock()
+	defer r.syncMutex.Unlock()
+
+	// Who has which name, the lowest peer id first
+	listing := make(map[string][]peer.ID)
+	publishers := r.publishers(ctx)
+	reachable := 0
+	var lastErr error
+	for _, publisher := range publishers {
+		names, err := r.getNames(ctx, publisher)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reachable++
+		for _, name := range names {
+			listing[name] = append(listing[name], publisher)
+		}
+	}
+	if len(publishers) > 0 && reachable == 0 {
+		return nil, lastErr
+	}
+
+	// Owners that dropped a name let go of it, new names go to whoever has them
+	for name, owner := range r.owners {
+		if owner != r.self && !containsPeer(listing[name], owner) {
+			delete(r.owners, name)
+		}
+	}
+	for name, ids := range listing {
+		if _, ok := r.owners[name]; !ok {
+			r.owners[name] = ids[0]
+		}
+	}
+
+	ours := r.publish(ctx)
+	names := make([]string, 0, len(ours))
+	for _, source := range ours {
+		names = append(names, source.Name)
+	}
+	if err := r.putNames(ctx, names); err != nil {
+		log.Println("Failed to publish source names to the DHT:", err)
+	}
+
+	sources := ours
+	for name, owner := range r.owners {
+		if owner == r.self {
+			continue
+		}
+
+		rec, err := r.getRecord(ctx, owner, name)
+		if err != nil {
+			log.Println("Skipping source", name, "without a valid record:", err)
+			continue
+		}
+		if rec == nil || rec.Removed {
+			delete(r.owners, name)
+			continue
+		}
+
+		sources = append(sources, rec.Source)
+	}
+
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Name < sources[j].Name })
+	return sources, nil
+}
+
+func containsPeer(ids []peer.ID, id peer.ID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *DHTRegistry) List(ctx context.Context) ([]model.Source, error) {
+	return r.sync(ctx)
+}
+
+func (r *DHTRegistry) Watch(ctx context.Context) <-chan Event {
+	return pollWatch(ctx, 5*time.Second, r.sync)
+}
+
+func (r *DHTRegistry) Add(ctx context.Context, source model.Source) error {
+	r.mutex.Lock()
+	delete(r.removed, source.Name)
+	r.added = append(withoutSource(r.added, source.Name), source)
+	r.mutex.Unlock()
+
+	// Only the record goes out here, the next poll lists the name and checks nobody had it first.
+	// If this fails the poll publishes the record too.
+	if err := r.putRecord(ctx, source, false); err != nil {
+		log.Println("Couldn't publish source", source.Name, "yet:", err)
+	}
+	return nil
+}
+
+func (r *DHTRegistry) Remove(ctx context.Context, name string) error {
+	r.mutex.Lock()
+	r.removed[name] = true
+	r.added = withoutSource(r.added, name)
+	r.mutex.Unlock()
+
+	_, err := r.sync(ctx)
+	return err
+}
@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+// FileRegistry keeps sources in a JSON lines file like the one util/generate-sources.go writes.
+// Changes to the file are picked up while the node is running.
+type FileRegistry struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+func NewFileRegistry(path string) *FileRegistry {
+	return &FileRegistry{Path: path}
+}
+
+func (r *FileRegistry) List(ctx context.Context) ([]model.Source, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.read()
+}
+
+// Reads the file, lines that don't parse are skipped rather than taking the whole registry down
+func (r *FileRegistry) read() ([]model.Source, error) {
+	bytes, err := os.ReadFile(r.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []model.Source{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sources := make([]model.Source, 0)
+	for i, line := range strings.Split(string(bytes), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var s model.Source
+		if err := json.Unmarshal([]byte(line), &s); err != nil || s.Name == "" || s.Cid == "" {
+			log.Printf("Skipping bad line %d in %s: %s", i+1, r.Path, line)
+			continue
+		}
+		sources = append(sources, s)
+	}
+
+	return mergeSources(sources), nil
+}
+
+func (r *FileRegistry) write(sources []model.Source) error {
+	builder := new(strings.Builder)
+	for i, s := range sources {
+		bytes, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			builder.WriteByte('\n')
+		}
+		builder.Write(bytes)
+	}
+
+	// Write then rename so a watcher never sees half a file
+	tmp := r.Path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(builder.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.Path)
+}
+
+// Watch rereads the file every couple of seconds.
+// Modification times are too coarse to tell quick edits apart and the file is small anyway.
+func (r *FileRegistry) Watch(ctx context.Context) <-chan Event {
+	return pollWatch(ctx, 2*time.Second, r.List)
+}
+
+func (r *FileRegistry) Add(ctx context.Context, source model.Source) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sources, err := r.read()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sources {
+		if s.Name == source.Name {
+			if s.Cid == source.Cid {
+				return nil
+			}
+			return errors.New("a different source called " + source.Name + " is already registered")
+		}
+	}
+
+	return r.write(append(sources, source))
+}
+
+func (r *FileRegistry) Remove(ctx context.Context, name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sources, err := r.read()
+	if err != nil {
+		return err
+	}
+
+	return r.write(withoutSource(sources, name))
+}
@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"openmesh.network/aggregationpoc/internal/gossip"
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+// GossipRegistry spreads sources through the node states gossiped by memberlist.
+// Every node shares every source it knows about so sources outlive the node that added them,
+// removals are shared the same way as tombstones. A removed name can't be used again.
+type GossipRegistry struct {
+	Gossip  *gossip.Instance
+	added   []model.Source
+	removed map[string]bool
+	mutex   sync.Mutex
+}
+
+// gossipStateProvider adds the registry's sources to the state of the node
+type gossipStateProvider struct {
+	registry *GossipRegistry
+	inner    gossip.StateProvider
+}
+
+func NewGossipRegistry(g *gossip.Instance) *GossipRegistry {
+	return &GossipRegistry{
+		Gossip:  g,
+		added:   make([]model.Source, 0),
+		removed: make(map[string]bool),
+	}
+}
+
+// WrapStateProvider makes the sources and removals ride along with the node's state,
+// use it in place of the provider given to gossip.Instance.SetStateProvider
+func (r *GossipRegistry) WrapStateProvider(p gossip.StateProvider) gossip.StateProvider {
+	return &gossipStateProvider{registry: r, inner: p}
+}
+
+func (p *gossipStateProvider) LocalState() model.NodeState {
+	state := p.inner.LocalState()
+	state.Sources, state.Removed = p.registry.collect()
+	return state
+}
+
+// collect merges what we know with what everyone else knows
+func (r *GossipRegistry) collect() ([]model.Source, []string) {
+	states := r.Gossip.ClusterState()
+
+	r.mutex.Lock()
+	removed := make(map[string]bool, len(r.removed))
+	for name := range r.removed {
+		removed[name] = true
+	}
+	lists := [][]model.Source{r.added}
+	r.mutex.Unlock()
+
+	for _, s := range states {
+		lists = append(lists, s.Sources)
+		for _, name := range s.Removed {
+			removed[name] = true
+		}
+	}
+
+	sources := mergeSources(lists...)
+	for name := range removed {
+		sources = withoutSource(sources, name)
+	}
+
+	removedNames := make([]string, 0, len(removed))
+	for name := range removed {
+		removedNames = append(removedNames, name)
+	}
+
+	// Keep the order stable, otherwise gossip sees a new state every time
+	sort.Strings(removedNames)
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Name < sources[j].Name
+	})
+
+	return sources, removedNames
+}
+
+func (r *GossipRegistry) List(ctx context.Context) ([]model.Source, error) {
+	sources, _ := r.collect()
+	return sources, nil
+}
+
+func (r *GossipRegistry) Watch(ctx context.Context) <-chan Event {
+	return pollWatch(ctx, 2*time.Second, r.List)
+}
+
+func (r *GossipRegistry) Add(ctx context.Context, source model.Source) error {
+	sources, removed := r.collect()
+	for _, name := range removed {
+		if name == source.Name {
+			return errors.New("source " + name + " was removed, the name can't be used again")
+		}
+	}
+	for _, s := range sources {
+		if s.Name == source.Name && s.Cid != source.Cid {
+			return errors.New("a different source called " + source.Name + " is already registered")
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.added = append(withoutSource(r.added, source.Name), source)
+	return nil
+}
+
+func (r *GossipRegistry) Remove(ctx context.Context, name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.removed[name] = true
+	r.added = withoutSource(r.added, name)
+	return nil
+}
@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"openmesh.network/aggregationpoc/internal/model"
+)
+
+const (
+	REGISTRY_FILE   = "file"
+	REGISTRY_DHT    = "dht"
+	REGISTRY_GOSSIP = "gossip"
+)
+
+// EventType is the kind of change made to a registry
+type EventType int8
+
+const (
+	SOURCE_ADDED EventType = iota
+	SOURCE_REMOVED
+)
+
+// Event is a single change to the list of sources
+type Event struct {
+	Type   EventType
+	Source model.Source
+}
+
+// Registry is where the list of sources the cluster stores comes from.
+// This stands in for a blockchain or smart contract.
+type Registry interface {
+	// List returns every source currently in the registry
+	List(ctx context.Context) ([]model.Source, error)
+	// Watch sends an event for every change to the registry until ctx is done.
+	// The sources already listed come through first as SOURCE_ADDED events.
+	Watch(ctx context.Context) <-chan Event
+	// Add puts a source in the registry, adding the exact same source again does nothing
+	Add(ctx context.Context, source model.Source) error
+	// Remove takes a source out of the registry by name
+	Remove(ctx context.Context, name string) error
+}
+
+// pollWatch turns a List function into a stream of events by diffing it every interval
+func pollWatch(ctx context.Context, interval time.Duration, list func(ctx context.Context) ([]model.Source, error)) <-chan Event {
+	events := make(chan Event)
+
+	go func() {
+		defer close(events)
+
+		known := make(map[string]model.Source)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			sources, err := list(ctx)
+			if err != nil {
+				log.Println("Failed to list sources:", err)
+			} else {
+				current := make(map[string]model.Source, len(sources))
+				pending := make([]Event, 0)
+
+				for _, s := range sources {
+					current[s.Name] = s
+				}
+				for name, s := range known {
+					if c, ok := current[name]; !ok || c.Cid != s.Cid {
+						pending = append(pending, Event{Type: SOURCE_REMOVED, Source: s})
+					}
+				}
+				for _, s := range sources {
+					if k, ok := known[s.Name]; !ok || k.Cid != s.Cid {
+						pending = append(pending, Event{Type: SOURCE_ADDED, Source: s})
+					}
+				}
+
+				for _, e := range pending {
+					select {
+					case events <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+				known = current
+			}
+
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events
+}
+
+// Merges sources in order, the first source with a name wins
+func mergeSources(lists ...[]model.Source) []model.Source {
+	merged := make([]model.Source, 0)
+	seen := make(map[string]bool)
+
+	for _, list := range lists {
+		for _, s := range list {
+			if s.Name == "" || seen[s.Name] {
+				continue
+			}
+			seen[s.Name] = true
+			merged = append(merged, s)
+		}
+	}
+
+	return merged
+}
+
+// Returns the sources without the one with the given name
+func withoutSource(sources []model.Source, name string) []model.Source {
+	filtered := make([]model.Source, 0, len(sources))
+	for _, s := range sources {
+		if s.Name != name {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
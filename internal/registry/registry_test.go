@@ -0,0 +1,129 @@
+package registry_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"openmesh.network/aggregationpoc/internal/gossip"
+	"openmesh.network/aggregationpoc/internal/model"
+	"openmesh.network/aggregationpoc/internal/p2p"
+	"openmesh.network/aggregationpoc/internal/registry"
+)
+
+func TestFileRegistry_List(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sources.json")
+	lines := `{"Name":"a","Size":10,"Cid":"bafya"}
+not json
+{"Name":"b","Size":20,"Cid":"bafyb"}`
+	assert.Nil(t, os.WriteFile(path, []byte(lines), 0644))
+
+	sources, err := registry.NewFileRegistry(path).List(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []model.Source{{Name: "a", Size: 10, Cid: "bafya"}, {Name: "b", Size: 20, Cid: "bafyb"}}, sources)
+}
+
+func TestFileRegistry_AddRemove(t *testing.T) {
+	ctx := context.Background()
+	r := registry.NewFileRegistry(filepath.Join(t.TempDir(), "sources.json"))
+
+	assert.Nil(t, r.Add(ctx, model.Source{Name: "a", Size: 10, Cid: "bafya"}))
+	assert.Nil(t, r.Add(ctx, model.Source{Name: "a", Size: 10, Cid: "bafya"}))
+	assert.NotNil(t, r.Add(ctx, model.Source{Name: "a", Size: 10, Cid: "bafyother"}))
+	assert.Nil(t, r.Add(ctx, model.Source{Name: "b", Size: 20, Cid: "bafyb"}))
+
+	sources, _ := r.List(ctx)
+	assert.Len(t, sources, 2)
+
+	assert.Nil(t, r.Remove(ctx, "a"))
+	sources, _ = r.List(ctx)
+	assert.Equal(t, []model.Source{{Name: "b", Size: 20, Cid: "bafyb"}}, sources)
+}
+
+func TestGossipRegistry_AddRemove(t *testing.T) {
+	ctx := context.Background()
+	g := gossip.NewInstance("registry-test", 0)
+	t.Cleanup(func() { g.Cluster.Shutdown() })
+	r := registry.NewGossipRegistry(g)
+
+	assert.Nil(t, r.Add(ctx, model.Source{Name: "a", Size: 10, Cid: "bafya"}))
+	assert.Nil(t, r.Add(ctx, model.Source{Name: "a", Size: 10, Cid: "bafya"}))
+	assert.NotNil(t, r.Add(ctx, model.Source{Name: "a", Size: 10, Cid: "bafyother"}))
+
+	// Removed names stay removed
+	assert.Nil(t, r.Remove(ctx, "a"))
+	assert.NotNil(t, r.Add(ctx, model.Source{Name: "a", Size: 10, Cid: "bafya"}))
+	sources, _ := r.List(ctx)
+	assert.Empty(t, sources)
+}
+
+func TestFileRegistry_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := registry.NewFileRegistry(filepath.Join(t.TempDir(), "sources.json"))
+	assert.Nil(t, r.Add(ctx, model.Source{Name: "a", Size: 10, Cid: "bafya"}))
+
+	events := r.Watch(ctx)
+	next := func() registry.Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for a registry event")
+			return registry.Event{}
+		}
+	}
+
+	assert.Equal(t, registry.Event{Type: registry.SOURCE_ADDED, Source: model.Source{Name: "a", Size: 10, Cid: "bafya"}}, next())
+
+	assert.Nil(t, r.Remove(ctx, "a"))
+	assert.Equal(t, registry.SOURCE_REMOVED, next().Type)
+}
+
+func TestDHTRegistry_Publishers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	gn := "Xnode-registry-test"
+	p1 := p2p.NewLibP2PInstance(0, gn, nil)
+	p2 := p2p.NewLibP2PInstance(0, gn, nil)
+	defer p1.Stop()
+	defer p2.Stop()
+	assert.Nil(t, p1.Start(ctx))
+	assert.Nil(t, p2.Start(ctx))
+	time.Sleep(5 * time.Second)
+
+	h1, h2 := *p1.Host, *p2.Host
+	r1 := registry.NewDHTRegistry(p1.DHT, h1.Peerstore().PrivKey(h1.ID()))
+	r2 := registry.NewDHTRegistry(p2.DHT, h2.Peerstore().PrivKey(h2.ID()))
+
+	// Both publish at once, neither list overwrites the other
+	a := model.Source{Name: "a", Size: 10, Cid: "bafybeihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"}
+	b := model.Source{Name: "b", Size: 20, Cid: "bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy"}
+	done := make(chan error, 2)
+	go func() { done <- r1.Add(ctx, a) }()
+	go func() { done <- r2.Add(ctx, b) }()
+	assert.Nil(t, <-done)
+	assert.Nil(t, <-done)
+
+	// Add only puts the record out, the names get listed as the registries sync
+	bothList := func(want []model.Source) bool {
+		listed := true
+		for _, r := range []*registry.DHTRegistry{r1, r2} {
+			sources, err := r.List(ctx)
+			listed = listed && err == nil && assert.ObjectsAreEqual(want, sources)
+		}
+		return listed
+	}
+	assert.Eventually(t, func() bool { return bothList([]model.Source{a, b}) }, 20*time.Second, 100*time.Millisecond)
+
+	// A name stays with whoever published it first
+	taken := model.Source{Name: "a", Size: 30, Cid: b.Cid}
+	assert.Nil(t, r2.Add(ctx, taken))
+	assert.True(t, bothList([]model.Source{a, b}))
+	assert.True(t, bothList([]model.Source{a, b}))
+}
@@ -8,8 +8,10 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"openmesh.network/aggregationpoc/internal/instance"
+	"openmesh.network/aggregationpoc/internal/ipfs"
 )
 
 func main() {
@@ -40,6 +42,142 @@ func main() {
 		p2pPort = 10090
 	}
 
+	ipfsConf := ipfs.DefaultConfig()
+	// XNODE_ROLE: seeder, storage, gateway or light
+	if role := os.Getenv("XNODE_ROLE"); role != "" {
+		ipfsConf.Role = role
+	}
+	// XNODE_SOURCES_DIR: string
+	if dir := os.Getenv("XNODE_SOURCES_DIR"); dir != "" {
+		ipfsConf.SourcesDir = dir
+	}
+	// XNODE_DATASTORE: memory, flatfs or leveldb
+	if ds := os.Getenv("XNODE_DATASTORE"); ds != "" {
+		ipfsConf.Datastore = ds
+	}
+	// XNODE_DATA_DIR: string
+	if dir := os.Getenv("XNODE_DATA_DIR"); dir != "" {
+		ipfsConf.DataDir = dir
+	}
+
+	// XNODE_REPLICATION_FACTOR: number
+	if replication, _ := strconv.Atoi(os.Getenv("XNODE_REPLICATION_FACTOR")); replication > 0 {
+		ipfsConf.ReplicationFactor = replication
+	}
+
+	// XNODE_ALLOCATION: random, rarest-first, deterministic or rendezvous
+	if allocation := os.Getenv("XNODE_ALLOCATION"); allocation != "" {
+		ipfsConf.Allocation = allocation
+	}
+	// XNODE_REGISTRY: file, dht or gossip
+	if reg := os.Getenv("XNODE_REGISTRY"); reg != "" {
+		ipfsConf.Registry = reg
+	}
+	// XNODE_SOURCES_FILE: string
+	if file := os.Getenv("XNODE_SOURCES_FILE"); file != "" {
+		ipfsConf.SourcesFile = file
+	}
+	// XNODE_PUBLISHERS: peer ids split by comma (,)
+	if publishers := os.Getenv("XNODE_PUBLISHERS"); publishers != "" {
+		ipfsConf.Publishers = strings.Split(publishers, ",")
+	}
+	// XNODE_CHUNKER: size-N, rabin-min-avg-max or buzhash
+	if spec := os.Getenv("XNODE_CHUNKER"); spec != "" {
+		ipfsConf.Chunker = spec
+	}
+	// XNODE_ERASURE: data+parity leaves per stripe, e.g. 4+2
+	if scheme := os.Getenv("XNODE_ERASURE"); scheme != "" {
+		data, parity, err := ipfs.ParseErasure(scheme)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ipfsConf.ErasureData = data
+		ipfsConf.ErasureParity = parity
+	}
+	// XNODE_HOT_REPLICAS: number, 0 turns off extra copies of hot leaves
+	if replicas, err := strconv.Atoi(os.Getenv("XNODE_HOT_REPLICAS")); err == nil && replicas >= 0 {
+		ipfsConf.HotReplicas = replicas
+	}
+	// XNODE_HOT_BUDGET: percent of the storage size
+	if budget, err := strconv.Atoi(os.Getenv("XNODE_HOT_BUDGET")); err == nil && budget >= 0 {
+		ipfsConf.HotBudget = budget
+	}
+	// XNODE_GC_INTERVAL: duration e.g. 10m, 0 to only collect when over the storage size
+	if interval := os.Getenv("XNODE_GC_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ipfsConf.GCInterval = d
+	}
+	// XNODE_SCRUB_RATE: blocks per second
+	if rate, _ := strconv.Atoi(os.Getenv("XNODE_SCRUB_RATE")); rate > 0 {
+		ipfsConf.ScrubRate = rate
+	}
+	// XNODE_SCRUB_INTERVAL: duration e.g. 1h, 0 turns the scrubber off
+	if interval := os.Getenv("XNODE_SCRUB_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ipfsConf.ScrubInterval = d
+	}
+	// XNODE_CHALLENGE_INTERVAL: duration e.g. 1m, 0 to never challenge peers
+	if interval := os.Getenv("XNODE_CHALLENGE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ipfsConf.ChallengeInterval = d
+	}
+	// XNODE_CHALLENGE_SAMPLE: number of leaves per peer
+	if sample, _ := strconv.Atoi(os.Getenv("XNODE_CHALLENGE_SAMPLE")); sample > 0 {
+		ipfsConf.ChallengeSample = sample
+	}
+	// XNODE_DRAIN_TIMEOUT: duration e.g. 5m, 0 to leave without handing off blocks
+	if timeout := os.Getenv("XNODE_DRAIN_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ipfsConf.DrainTimeout = d
+	}
+	// XNODE_FAILURE_GRACE: duration e.g. 30s
+	if grace := os.Getenv("XNODE_FAILURE_GRACE"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ipfsConf.FailureGrace = d
+	}
+	// XNODE_UPLOAD_LIMIT, XNODE_DOWNLOAD_LIMIT, XNODE_PEER_UPLOAD_LIMIT, XNODE_PEER_DOWNLOAD_LIMIT: bytes per second
+	for env, limit := range map[string]*int64{
+		"XNODE_UPLOAD_LIMIT":        &ipfsConf.Bandwidth.Upload,
+		"XNODE_DOWNLOAD_LIMIT":      &ipfsConf.Bandwidth.Download,
+		"XNODE_PEER_UPLOAD_LIMIT":   &ipfsConf.Bandwidth.PeerUpload,
+		"XNODE_PEER_DOWNLOAD_LIMIT": &ipfsConf.Bandwidth.PeerDownload,
+	} {
+		if value := os.Getenv(env); value != "" {
+			bytes, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || bytes < 0 {
+				log.Fatal(env + " has to be a number of bytes per second, 0 for no limit")
+			}
+			*limit = bytes
+		}
+	}
+	// XNODE_MIN_REPUTATION: score between 0 and 1
+	if threshold := os.Getenv("XNODE_MIN_REPUTATION"); threshold != "" {
+		score, err := strconv.ParseFloat(threshold, 64)
+		if err != nil || score < 0 || score > 1 {
+			log.Fatal("XNODE_MIN_REPUTATION has to be between 0 and 1")
+		}
+		ipfsConf.MinReputation = score
+	}
+	// XNODE_HOT_THRESHOLD: number of requests within the window
+	if threshold, _ := strconv.Atoi(os.Getenv("XNODE_HOT_THRESHOLD")); threshold > 0 {
+		ipfsConf.HotThreshold = threshold
+	}
+
 	log.Println("Calling gossip peers")
 
 	// XNODE_XXXX_PEERS: addresses split by comma (,)
@@ -75,18 +213,44 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 
 	// Initialise and start the instance
-	pocInstance := instance.NewInstance(peerName, groupName, gossipPort, httpPort, p2pPort)
+	pocInstance := instance.NewInstance(peerName, groupName, gossipPort, httpPort, p2pPort, ipfsConf)
 	pocInstance.Start(cancelCtx, gossipPeers, httpPeers)
 
 	// Stop here!
-	sig := <-sigChan
-	log.Printf("Termination signal received: %v", sig)
+	drain := false
+	select {
+	case sig := <-sigChan:
+		log.Printf("Termination signal received: %v", sig)
+		// SIGTERM is a planned shutdown, anything else leaves straight away
+		drain = sig == syscall.SIGTERM
+	case <-pocInstance.Ipfs.DrainRequested():
+		log.Println("Drain requested")
+		drain = true
+	}
+
+	if drain && ipfsConf.DrainTimeout > 0 {
+		drainCtx, cancelDrain := context.WithTimeout(cancelCtx, ipfsConf.DrainTimeout)
+		go func() {
+			// A second signal gives up on draining
+			select {
+			case <-sigChan:
+				cancelDrain()
+			case <-drainCtx.Done():
+			}
+		}()
+		if err := pocInstance.Ipfs.Drain(drainCtx); err != nil {
+			log.Printf("Leaving before every block was handed off: %s", err.Error())
+		}
+		cancelDrain()
+	}
 
 	// Cleanup
 	if err := pocInstance.Gossip.Leave(); err != nil {
 		log.Printf("Failed to leave the cluster: %s", err.Error())
 	}
 	pocInstance.HTTP.Stop()
+	// Before the DHT goes, the registry polls it until the instance is stopped
+	pocInstance.Ipfs.Stop()
 	if err := pocInstance.P2P.Stop(); err != nil {
 		log.Printf("Failed to stop libp2p instance: %s", err.Error())
 	}
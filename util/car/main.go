@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var node = flag.String("node", "http://127.0.0.1:9080", "the HTTP API of the node to talk to")
+var version = flag.Int("version", 1, "export as CARv1 or CARv2")
+var name = flag.String("name", "", "the source to import the car as, defaults to the file name without .car")
+
+// Exports sources or CIDs from a node as CAR files and imports CAR files into a node:
+//
+//	go run ./util/car export <source or cid> [file]
+//	go run ./util/car -name <source> import <file>
+func main() {
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: car [flags] export <source or cid> [file] | car [flags] import <file>")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "export":
+		out := args[1] + ".car"
+		if len(args) > 2 {
+			out = args[2]
+		}
+		err = exportCar(args[1], out)
+	case "import":
+		err = importCar(args[1])
+	default:
+		err = fmt.Errorf("unknown command %s", args[0])
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func exportCar(ref string, out string) error {
+	res, err := http.Get(fmt.Sprintf("%s/car/%s?version=%d", *node, url.PathEscape(ref), *version))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, res.Body)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Wrote", n/1024, "KB to", out)
+	return nil
+}
+
+func importCar(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	source := *name
+	if source == "" {
+		source = strings.TrimSuffix(filepath.Base(path), ".car")
+	}
+
+	res, err := http.Post(*node+"/car?name="+url.QueryEscape(source), "application/vnd.ipld.car", f)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return responseError(res)
+	}
+
+	body, _ := io.ReadAll(res.Body)
+	log.Println("Imported", source+":", string(body))
+	return nil
+}
+
+func responseError(res *http.Response) error {
+	body, _ := io.ReadAll(res.Body)
+	return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+}
@@ -2,39 +2,44 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/ipfs/go-datastore"
 	dsync "github.com/ipfs/go-datastore/sync"
 
-	"github.com/ipfs/go-cid"
-	"github.com/multiformats/go-multicodec"
-
 	"github.com/ipfs/boxo/blockservice"
 	blockstore "github.com/ipfs/boxo/blockstore"
-	chunker "github.com/ipfs/boxo/chunker"
 	offline "github.com/ipfs/boxo/exchange/offline"
 	"github.com/ipfs/boxo/ipld/merkledag"
-	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
-	uih "github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+
+	"openmesh.network/aggregationpoc/internal/ipfs"
+	"openmesh.network/aggregationpoc/internal/model"
 )
 
 const exampleBinaryName = "m"
 
-type Source struct {
-	Name string
-	Cid  string
-	Size int64
-}
+var chunkerSpec = flag.String("chunker", model.DefaultChunker, "how to split the sources into leaves: size-N, rabin-min-avg-max or buzhash")
+var erasureScheme = flag.String("erasure", "", "erasure code the sources, data+parity leaves per stripe e.g. 4+2")
 
 func main() {
 	flag.Parse()
 
+	data, parity := 0, 0
+	if *erasureScheme != "" {
+		var err error
+		data, parity, err = ipfs.ParseErasure(*erasureScheme)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	entries, err := os.ReadDir("./sources")
 
 	if err != nil {
@@ -48,24 +53,22 @@ func main() {
 		fmt.Println(e.Name())
 
 		f, _ := e.Info()
-		if !f.IsDir() {
-			// Ignore hidden files, and empty files.
-			if f.Name()[0] != '.' && f.Size() > 0 {
-				c, err := getCidFromFile("./sources/" + f.Name())
-
-				if err != nil {
-					panic(err)
-				}
+		// Ignore hidden files, and empty files. Directories become a single source.
+		if f.Name()[0] != '.' && (f.IsDir() || f.Size() > 0) {
+			source, err := getSource("./sources/"+f.Name(), f.IsDir(), *chunkerSpec, data, parity)
 
-				bytes, _ := json.Marshal(Source{Name: f.Name(), Size: f.Size(), Cid: c.String()})
+			if err != nil {
+				panic(err)
+			}
 
-				if count > 0 {
-					builder.WriteByte('\n')
-				}
+			bytes, _ := json.Marshal(source)
 
-				count++
-				builder.Write(bytes)
+			if count > 0 {
+				builder.WriteByte('\n')
 			}
+
+			count++
+			builder.Write(bytes)
 		}
 	}
 	os.WriteFile("sources.json", []byte(builder.String()), 0644)
@@ -74,15 +77,10 @@ func main() {
 
 }
 
-func getCidFromFile(filename string) (cid.Cid, error) {
-	fileBytes, err := os.ReadFile(filename)
-
-	if err != nil {
-		return cid.Undef, err
-	}
-	fileReader := bytes.NewReader(fileBytes)
-
-	ds := dsync.MutexWrap(&datastore.NullDatastore{})
+// Chunks a file or a directory the same way a node ingesting it would and describes it as a source
+func getSource(path string, dir bool, spec string, data int, parity int) (model.Source, error) {
+	// The leaf sizes and the parity are worked out from the leaves so they have to stick around
+	ds := dsync.MutexWrap(datastore.NewMapDatastore())
 	bs := blockstore.NewBlockstore(ds)
 	bs = blockstore.NewIdStore(bs)
 
@@ -91,25 +89,16 @@ func getCidFromFile(filename string) (cid.Cid, error) {
 	bsrv := blockservice.New(bs, offline.Exchange(bs))
 	dsrv := merkledag.NewDAGService(bsrv)
 
-	ufsImportParams := uih.DagBuilderParams{
-		Maxlinks:  uih.DefaultLinksPerBlock,
-		RawLeaves: true,
-		CidBuilder: cid.V1Builder{
-			Codec:    uint64(multicodec.DagPb),
-			MhType:   uint64(multicodec.Sha2_256),
-			MhLength: -1,
-		},
-		Dagserv: dsrv,
-		NoCopy:  false,
+	if dir {
+		return ipfs.ImportDirectory(context.Background(), dsrv, filepath.Base(path), path, spec, data, parity)
 	}
-	ufsBuilder, err := ufsImportParams.New(chunker.NewSizeSplitter(fileReader, chunker.DefaultBlockSize))
-	if err != nil {
-		return cid.Undef, err
-	}
-	nd, err := balanced.Layout(ufsBuilder)
+
+	fileBytes, err := os.ReadFile(path)
+
 	if err != nil {
-		return cid.Undef, err
+		return model.Source{}, err
 	}
+	fileReader := bytes.NewReader(fileBytes)
 
-	return nd.Cid(), nil
+	return ipfs.ImportSource(context.Background(), dsrv, filepath.Base(path), fileReader, spec, data, parity)
 }